@@ -34,6 +34,7 @@ import (
 	"strconv"
 
 	"github.com/spf13/cobra"
+	"vawter.tech/mdcmux/internal/proxy"
 	"vawter.tech/mdcmux/pkg/conn"
 	"vawter.tech/mdcmux/pkg/message"
 )
@@ -50,16 +51,21 @@ func Command() *cobra.Command {
 			return f.Run(cmd.Context())
 		},
 	}
+	cmd.Flags().StringVarP(&f.cfgPath, "config", "c", "", "A proxy configuration file whose symbols name the variables")
 	cmd.Flags().StringVar(&f.host, "host", "", "The hostname:port to connect to")
 	cmd.Flags().StringVarP(&f.path, "out", "o", "", "The path to write the results to; defaults to stdout if unset")
 	cmd.Flags().IntVarP(&f.start, "start", "s", 0, "The first macro variable number to fetch")
 	cmd.Flags().IntVarP(&f.end, "end", "e", 0, "The last macro variable number to fetch; defaults to start if unset")
+	cmd.Flags().StringVar(&f.target, "target", "", "The target whose symbols are used; defaults to the host")
 	return cmd
 }
 
 type fetcher struct {
-	host, path string
-	start, end int
+	cfgPath, target string
+	host, path      string
+	start, end      int
+
+	symbols *proxy.SymbolTable
 }
 
 func (f *fetcher) Run(ctx context.Context) error {
@@ -77,6 +83,11 @@ func (f *fetcher) Run(ctx context.Context) error {
 	if count <= 0 {
 		return errors.New("end variable number must be less than or equal to start")
 	}
+	if f.cfgPath != "" {
+		if err := f.loadSymbols(); err != nil {
+			return err
+		}
+	}
 	buf := make([]message.Number, count)
 	if err := f.fetch(ctx, buf); err != nil {
 		return err
@@ -84,6 +95,28 @@ func (f *fetcher) Run(ctx context.Context) error {
 	return f.write(ctx, buf)
 }
 
+// loadSymbols reads the symbol table of the target from the configuration
+// file.
+func (f *fetcher) loadSymbols() error {
+	file, err := os.Open(f.cfgPath)
+	if err != nil {
+		return fmt.Errorf("could not open configuration file %s: %w", f.cfgPath, err)
+	}
+	defer func() { _ = file.Close() }()
+	cfg, err := proxy.ReadConfig(file)
+	if err != nil {
+		return fmt.Errorf("could not decode configuration file %s: %w", f.cfgPath, err)
+	}
+	// Don't expand the configuration, which would load TLS key pairs that
+	// are only available to the proxy.
+	target := f.target
+	if target == "" {
+		target = f.host
+	}
+	f.symbols, err = cfg.SymbolTable(target)
+	return err
+}
+
 func (f *fetcher) fetch(ctx context.Context, buf []message.Number) error {
 	c := conn.New(f.host)
 	defer c.Close()
@@ -116,10 +149,21 @@ func (f *fetcher) write(_ context.Context, buf []message.Number) error {
 
 	table := csv.NewWriter(w)
 	for i, num := range buf {
-		if err := table.Write([]string{
+		row := []string{
 			strconv.Itoa(f.start + i),
 			num.String(),
-		}); err != nil {
+		}
+		// Symbolic names and units are included when a configuration is
+		// provided.
+		if f.cfgPath != "" {
+			name, sym, ok := f.symbols.Name(f.start + i)
+			if ok {
+				row = append(row, name, sym.Units)
+			} else {
+				row = append(row, "", "")
+			}
+		}
+		if err := table.Write(row); err != nil {
 			return err
 		}
 	}
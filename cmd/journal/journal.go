@@ -0,0 +1,254 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+// Package journal contains commands to inspect the write journal and to roll
+// back recorded writes.
+package journal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"vawter.tech/mdcmux/internal/proxy"
+	"vawter.tech/mdcmux/pkg/message"
+)
+
+// Command is an entrypoint for write journal tools.
+func Command() *cobra.Command {
+	f := &filter{}
+	cmd := &cobra.Command{
+		Use:   "journal",
+		Short: "Inspect the write journal",
+	}
+	flags := cmd.PersistentFlags()
+	flags.StringVar(&f.client, "client", "", "only include writes from the client IP address")
+	flags.StringVarP(&f.path, "journal", "j", "", "the journal file")
+	flags.StringVar(&f.session, "session", "", "only include writes from the session")
+	flags.StringVar(&f.since, "since", "", "only include writes at or after an RFC 3339 time")
+	flags.StringVar(&f.target, "target", "", "only include writes to the target hostname:port")
+	flags.StringVar(&f.until, "until", "", "only include writes before an RFC 3339 time")
+
+	cmd.AddCommand(listCommand(f), rollbackCommand(f))
+	return cmd
+}
+
+func listCommand(f *filter) *cobra.Command {
+	return &cobra.Command{
+		Args:  cobra.NoArgs,
+		Use:   "list",
+		Short: "List recorded writes",
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			entries, err := f.load()
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+			_, _ = fmt.Fprintln(w, "TIME\tSESSION\tCLIENT\tPRINCIPAL\tTARGET\tVARIABLE\tOLD\tNEW")
+			for _, e := range entries {
+				_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+					e.Time.Format(time.RFC3339), e.Session, e.Client, e.Principal,
+					e.Target, e.Variable, e.Old, e.New)
+			}
+			return w.Flush()
+		},
+	}
+}
+
+func rollbackCommand(f *filter) *cobra.Command {
+	var apply bool
+	var principal, proxyAddr string
+	cmd := &cobra.Command{
+		Args:  cobra.NoArgs,
+		Use:   "rollback",
+		Short: "Generate or apply writes which undo recorded writes",
+		Long: `Generate the writes which restore the variables changed by the selected
+journal entries to the values they held before the earliest entry. With
+--apply, the writes are sent through the proxy, so that they are subject to
+the normal policy checks. A token for --principal is read from the
+MDCMUX_TOKEN environment variable.`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			entries, err := f.load()
+			if err != nil {
+				return err
+			}
+			undo := proxy.Rollback(entries)
+			out := cmd.OutOrStdout()
+			if len(undo) == 0 {
+				_, _ = fmt.Fprintln(out, "no writes selected")
+				return nil
+			}
+			if !apply {
+				for _, u := range undo {
+					_, _ = fmt.Fprintf(out, "%s\t?E%d %s\n", u.Target, u.Variable, u.New)
+				}
+				return nil
+			}
+
+			if proxyAddr == "" {
+				return errors.New("no proxy address specified")
+			}
+			for _, u := range undo[1:] {
+				if u.Target != undo[0].Target {
+					return errors.New("the writes affect more than one target; use --target")
+				}
+			}
+			var token string
+			if principal != "" {
+				token = os.Getenv("MDCMUX_TOKEN")
+				if token == "" {
+					return errors.New("MDCMUX_TOKEN is not set")
+				}
+			}
+			return applyRollback(cmd.Context(), out, proxyAddr, principal, token, undo)
+		},
+	}
+	cmd.Flags().BoolVar(&apply, "apply", false, "send the writes through the proxy")
+	cmd.Flags().StringVar(&principal, "principal", "", "authenticate to the proxy as a principal")
+	cmd.Flags().StringVar(&proxyAddr, "proxy", "", "the proxy hostname:port for the target")
+	return cmd
+}
+
+// applyRollback sends the writes through the proxy. Every write is attempted,
+// and an error is returned if any write fails.
+func applyRollback(
+	ctx context.Context, out io.Writer, addr, principal, token string, undo []*proxy.JournalEntry,
+) error {
+	if len(undo) == 0 {
+		return nil
+	}
+	var d net.Dialer
+	raw, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = raw.Close() }()
+
+	in := bufio.NewScanner(raw)
+	in.Split(message.ScanPrompt)
+	// Consume the initial prompt.
+	if !in.Scan() {
+		return fmt.Errorf("no prompt from proxy: %w", in.Err())
+	}
+	send := func(line string) (string, error) {
+		if _, err := fmt.Fprintf(raw, "%s%s", line, message.EOL); err != nil {
+			return "", err
+		}
+		if !in.Scan() {
+			if err := in.Err(); err != nil {
+				return "", err
+			}
+			return "", io.ErrUnexpectedEOF
+		}
+		return in.Text(), nil
+	}
+
+	if principal != "" {
+		reply, err := send(fmt.Sprintf("?XAUTH %s %s", principal, token))
+		if err != nil {
+			return err
+		}
+		if reply != "!" {
+			return fmt.Errorf("could not authenticate: %s", reply)
+		}
+	}
+
+	failed := 0
+	for _, u := range undo {
+		line := fmt.Sprintf("?E%d %s", u.Variable, u.New)
+		reply, err := send(line)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(reply, "?") {
+			failed++
+		}
+		_, _ = fmt.Fprintf(out, "%s\t%s\t%s\n", u.Target, line, reply)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d writes failed", failed, len(undo))
+	}
+	return nil
+}
+
+// filter selects journal entries.
+type filter struct {
+	client, path, session, since, target, until string
+}
+
+// load reads the journal and returns the selected entries.
+func (f *filter) load() ([]*proxy.JournalEntry, error) {
+	if f.path == "" {
+		return nil, errors.New("no journal file specified")
+	}
+	var client netip.Addr
+	var since, until time.Time
+	var err error
+	if f.client != "" {
+		if client, err = netip.ParseAddr(f.client); err != nil {
+			return nil, fmt.Errorf("invalid client address: %w", err)
+		}
+	}
+	if f.since != "" {
+		if since, err = time.Parse(time.RFC3339, f.since); err != nil {
+			return nil, fmt.Errorf("invalid since time: %w", err)
+		}
+	}
+	if f.until != "" {
+		if until, err = time.Parse(time.RFC3339, f.until); err != nil {
+			return nil, fmt.Errorf("invalid until time: %w", err)
+		}
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+	entries, err := proxy.ReadJournal(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read journal %s: %w", f.path, err)
+	}
+
+	ret := entries[:0]
+	for _, e := range entries {
+		switch {
+		case client.IsValid() && e.Client != client:
+		case f.session != "" && e.Session != f.session:
+		case f.target != "" && e.Target != f.target:
+		case !since.IsZero() && e.Time.Before(since):
+		case !until.IsZero() && !e.Time.Before(until):
+		default:
+			ret = append(ret, e)
+		}
+	}
+	return ret, nil
+}
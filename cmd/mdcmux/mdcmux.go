@@ -23,7 +23,6 @@
 package mdcmux
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -67,7 +66,6 @@ func Command() *cobra.Command {
 							continue
 						}
 						lastModTime = info.ModTime()
-						nextCfg := &proxy.Config{}
 
 						f, err := os.Open(cfgPath)
 						if err != nil {
@@ -77,9 +75,9 @@ func Command() *cobra.Command {
 							continue
 						}
 
-						dec := json.NewDecoder(f)
-						dec.DisallowUnknownFields()
-						if err := dec.Decode(nextCfg); err != nil {
+						nextCfg, err := proxy.ReadConfig(f)
+						_ = f.Close()
+						if err != nil {
 							slog.ErrorContext(ctx, "could not decode configuration file",
 								slog.String("path", cfgPath),
 								slog.Any("error", err))
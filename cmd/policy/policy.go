@@ -0,0 +1,226 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+// Package policy contains commands to inspect the policies in a configuration
+// file.
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"vawter.tech/mdcmux/internal/proxy"
+)
+
+// Command is an entrypoint for policy inspection tools.
+func Command() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "policy",
+		Short: "Inspect the policies in a configuration file",
+	}
+	cmd.AddCommand(explainCommand())
+	return cmd
+}
+
+func explainCommand() *cobra.Command {
+	e := &explainer{}
+	cmd := &cobra.Command{
+		Args:  cobra.MaximumNArgs(1),
+		Use:   "explain [command]",
+		Short: "Explain the policy decision for a command",
+		Long: `Explain which policy entry applies to a client of a target and whether the
+policy allows a command, such as '?E10900 1.5' or '?E @PALLET_READY 1'. The
+target's mode is read from the configuration and any mode files; overrides
+made through the admin interface are not known. Write rules and interlocks
+which depend on the state of the machine cannot be evaluated and will be
+reported as denials.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				e.command = args[0]
+			}
+			return e.Run(cmd)
+		},
+	}
+	cmd.Flags().StringVar(&e.at, "at", "", "evaluate schedules at an RFC 3339 time instead of now")
+	cmd.Flags().StringVar(&e.client, "client", "", "the client IP address")
+	cmd.Flags().StringVarP(&e.cfgPath, "config", "c", "", "configuration file")
+	cmd.Flags().StringVar(&e.principal, "principal", "", "treat the client as an authenticated principal")
+	cmd.Flags().StringVar(&e.target, "target", "", "the hostname or hostname:port of the target")
+	cmd.Flags().BoolVar(&e.writes, "writes", false, "list the variables the client may write on every target")
+	return cmd
+}
+
+type explainer struct {
+	at, cfgPath, client, command, principal, target string
+	writes                                          bool
+}
+
+func (e *explainer) Run(cmd *cobra.Command) error {
+	if e.cfgPath == "" {
+		return errors.New("no configuration file specified")
+	}
+	if e.client == "" {
+		return errors.New("no client address specified")
+	}
+	if e.command == "" && !e.writes {
+		return errors.New("no command specified")
+	}
+	if e.command != "" && e.target == "" {
+		return errors.New("no target specified")
+	}
+	client, err := netip.ParseAddr(e.client)
+	if err != nil {
+		return fmt.Errorf("invalid client address: %w", err)
+	}
+	now := time.Now()
+	if e.at != "" {
+		now, err = time.Parse(time.RFC3339, e.at)
+		if err != nil {
+			return fmt.Errorf("invalid time: %w", err)
+		}
+	}
+
+	f, err := os.Open(e.cfgPath)
+	if err != nil {
+		return fmt.Errorf("could not open configuration file %s: %w", e.cfgPath, err)
+	}
+	cfg, err := proxy.ReadConfig(f)
+	_ = f.Close()
+	if err != nil {
+		return fmt.Errorf("could not decode configuration file %s: %w", e.cfgPath, err)
+	}
+	if err := cfg.Expand(); err != nil {
+		return fmt.Errorf("invalid configuration file %s: %w", e.cfgPath, err)
+	}
+
+	out := cmd.OutOrStdout()
+	if e.command != "" {
+		ex, err := cfg.Explain(cmd.Context(), e.target, client, e.principal, e.command, now)
+		if err != nil {
+			return err
+		}
+		if err := printExplanation(out, ex); err != nil {
+			return err
+		}
+	}
+	if e.writes {
+		access, err := cfg.WriteAccess(client, e.principal, now)
+		if err != nil {
+			return err
+		}
+		printWriteAccess(out, access)
+	}
+	return nil
+}
+
+func printExplanation(out io.Writer, ex *proxy.Explanation) error {
+	principal := ex.Principal
+	if principal == "" {
+		principal = "(none)"
+	}
+	_, _ = fmt.Fprintf(out, "target:    %s\n", ex.Target)
+	_, _ = fmt.Fprintf(out, "principal: %s\n", principal)
+	_, _ = fmt.Fprintf(out, "command:   %s\n", strings.TrimSpace(ex.Command.String()))
+	if ex.Symbol != "" {
+		_, _ = fmt.Fprintf(out, "symbol:    %s\n", ex.Symbol)
+	}
+	_, _ = fmt.Fprintf(out, "mode:      %s\n", ex.Mode)
+
+	if entry := ex.Entry; entry == nil {
+		_, _ = fmt.Fprintln(out, "entry:     (none)")
+	} else {
+		scope := "global"
+		if entry.Target {
+			scope = "target"
+		}
+		var kind string
+		switch {
+		case entry.Identity != "":
+			kind = "identity " + entry.Identity
+		case entry.Deny:
+			kind = "deny " + entry.Prefix.String()
+		default:
+			kind = "netblock " + entry.Prefix.String()
+		}
+		_, _ = fmt.Fprintf(out, "entry:     #%d, %s %s\n", ex.Index+1, scope, kind)
+		if entry.Policy != nil {
+			buf, err := json.MarshalIndent(entry.Policy, "           ", "  ")
+			if err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintf(out, "policy:    %s\n", buf)
+		}
+	}
+
+	if ex.Remapped != nil {
+		_, _ = fmt.Fprintf(out, "remapped:  %s\n", strings.TrimSpace(fmt.Sprint(ex.Remapped)))
+	}
+	if ex.Allowed {
+		_, _ = fmt.Fprintln(out, "decision:  allow")
+	} else {
+		_, _ = fmt.Fprintf(out, "decision:  deny (%s)\n", ex.Reason)
+	}
+	for _, limit := range ex.WriteLimits {
+		_, _ = fmt.Fprintf(out, "limit:     %d writes per %s to variables %d-%d\n",
+			limit.Writes, limit.Interval, limit.Variables[0], limit.Variables[1])
+	}
+	if budget := ex.WriteBudget; budget != nil {
+		_, _ = fmt.Fprintf(out, "budget:    %d writes per %s to the target\n", budget.Writes, budget.Interval)
+	}
+	if ex.NeedsState {
+		_, _ = fmt.Fprintln(out, "note:      the decision depends on the state of the machine")
+	}
+	if len(ex.WriteLimits) > 0 || ex.WriteBudget != nil {
+		_, _ = fmt.Fprintln(out, "note:      the write is denied if a rate limit has been reached")
+	}
+	return nil
+}
+
+func printWriteAccess(out io.Writer, access []*proxy.WriteAccess) {
+	_, _ = fmt.Fprintln(out, "writes:")
+	if len(access) == 0 {
+		_, _ = fmt.Fprintln(out, "  (none)")
+		return
+	}
+	for _, a := range access {
+		ranges := make([]string, len(a.Ranges))
+		for i, r := range a.Ranges {
+			if r[0] == r[1] {
+				ranges[i] = fmt.Sprintf("#%d", r[0])
+			} else {
+				ranges[i] = fmt.Sprintf("#%d-#%d", r[0], r[1])
+			}
+		}
+		line := fmt.Sprintf("  %s: %s", a.Target, strings.Join(ranges, ", "))
+		if a.Conditional {
+			line += " (conditional)"
+		}
+		_, _ = fmt.Fprintln(out, line)
+	}
+}
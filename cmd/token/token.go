@@ -0,0 +1,74 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+// Package token contains a command to create secrets for the XAUTH command.
+package token
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"vawter.tech/mdcmux/internal/proxy"
+)
+
+// Command is an entrypoint to generate a token and its hashed form.
+func Command() *cobra.Command {
+	var stdin bool
+	cmd := &cobra.Command{
+		Args:  cobra.NoArgs,
+		Use:   "token",
+		Short: "Generate a token for a principal",
+		Long: `Generate a random token to be presented with the XAUTH command. The hashed
+form of the token should be added to a principal's tokens in the
+configuration file.`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			var token string
+			if stdin {
+				line, err := bufio.NewReader(cmd.InOrStdin()).ReadString('\n')
+				token = strings.TrimSpace(line)
+				if token == "" {
+					if err != nil {
+						return fmt.Errorf("could not read token: %w", err)
+					}
+					return errors.New("empty token")
+				}
+				if strings.ContainsAny(token, " \t") {
+					return errors.New("tokens may not contain whitespace")
+				}
+			} else {
+				buf := make([]byte, 24)
+				_, _ = rand.Read(buf)
+				token = base64.RawURLEncoding.EncodeToString(buf)
+				_, _ = fmt.Fprintf(cmd.OutOrStdout(), "token: %s\n", token)
+			}
+			_, _ = fmt.Fprintf(cmd.OutOrStdout(), "hash:  %s\n", proxy.HashToken(token))
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&stdin, "stdin", false, "hash an existing token read from stdin")
+	return cmd
+}
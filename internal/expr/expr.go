@@ -0,0 +1,122 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+// Package expr implements a small expression language for access rules.
+//
+// An expression combines comparisons with the boolean operators &&, ||, and
+// !. Values are numbers, strings, booleans, or lists of strings. Comparisons
+// use ==, !=, <, <=, >, and >=. Membership is tested with the in operator,
+// either against an inclusive numeric range, as in "var in 100..199", a list
+// literal, as in "weekday in ['sat', 'sun']", or a list-valued variable.
+//
+// Expressions are type-checked against an [Env] when they are compiled, so
+// that mistakes are reported when a configuration is loaded rather than when
+// a rule is evaluated.
+package expr
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A Type is the type of a value in an expression.
+type Type int
+
+// The types of values in an expression.
+const (
+	Bool Type = iota + 1
+	Number
+	String
+	StringList
+	numberList // List literals only.
+)
+
+func (t Type) String() string {
+	switch t {
+	case Bool:
+		return "bool"
+	case Number:
+		return "number"
+	case String:
+		return "string"
+	case StringList, numberList:
+		return "list"
+	default:
+		return "unknown"
+	}
+}
+
+// An Env declares the variables which may be used by an expression.
+type Env map[string]Type
+
+// Values supplies variables when an expression is evaluated. The Go types
+// bool, float64, string, and []string correspond to the expression types.
+type Values map[string]any
+
+// A Program is a compiled expression.
+type Program struct {
+	root node
+	src  string
+}
+
+// Compile parses and type-checks a boolean expression.
+func Compile(src string, env Env) (*Program, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{env: env, toks: toks}
+	root, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	if root.typ() != Bool {
+		return nil, fmt.Errorf("expression must be a bool, not a %s", root.typ())
+	}
+	return &Program{root: root, src: src}, nil
+}
+
+// Eval evaluates the expression. An error is returned if a variable is
+// missing or has the wrong type.
+func (p *Program) Eval(values Values) (ok bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, isErr := r.(evalError); isErr {
+				err = e.err
+				return
+			}
+			panic(r)
+		}
+	}()
+	return p.root.eval(values).(bool), nil
+}
+
+// String returns the source of the expression.
+func (p *Program) String() string { return p.src }
+
+// evalError is used to unwind evaluation. It is a distinct type so that
+// unrelated panics are not mistaken for evaluation errors.
+type evalError struct{ err error }
+
+func missing(name string) evalError {
+	return evalError{errors.New("missing value for " + name)}
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package expr
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testEnv = Env{
+	"cmd.write": Bool,
+	"groups":    StringList,
+	"hour":      Number,
+	"value":     Number,
+	"var":       Number,
+	"weekday":   String,
+}
+
+func TestEval(t *testing.T) {
+	values := Values{
+		"cmd.write": true,
+		"groups":    []string{"engineering", "staff"},
+		"hour":      float64(7),
+		"value":     float64(-2.5),
+		"var":       float64(10800),
+		"weekday":   "sat",
+	}
+
+	tcs := []struct {
+		src      string
+		expected bool
+	}{
+		{"true", true},
+		{"!true", false},
+		{"cmd.write && var in 10800..10999 && value >= -3 && hour >= 6", true},
+		{"cmd.write && var in 10801..10999", false},
+		{"var in 10000..10800.5", true},
+		{"value == -2.5", true},
+		{"value < -2.5 || value > -2.5", false},
+		{"!(hour < 6) && hour <= 18", true},
+		{"weekday in ['sat', \"sun\"]", true},
+		{"weekday != 'sun'", true},
+		{"'engineering' in groups", true},
+		{"'admin' in groups", false},
+		{"var in [1, 10800, -5]", true},
+		{"false || true && false", false},
+		{"cmd.write == true", true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.src, func(t *testing.T) {
+			r := require.New(t)
+			p, err := Compile(tc.src, testEnv)
+			r.NoError(err)
+			ok, err := p.Eval(values)
+			r.NoError(err)
+			r.Equal(tc.expected, ok)
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tcs := []struct {
+		src string
+		err string
+	}{
+		{"", "unexpected end of expression"},
+		{"hour", "expression must be a bool, not a number"},
+		{"hours > 6", `unknown name "hours"`},
+		{"hour > '6'", "cannot compare number with string"},
+		{"weekday < 'mon'", "< requires number operands"},
+		{"hour && true", "&& requires bool operands"},
+		{"!hour", "! requires a bool operand"},
+		{"-weekday == 1", "- requires a number operand"},
+		{"weekday in 1..5", "ranges require number operands"},
+		{"hour in groups", "cannot test number in list"},
+		{"[1] == [1]", "cannot compare lists"},
+		{"['a'] != ['b']", "cannot compare lists"},
+		{"groups == groups", "cannot compare lists"},
+		{"[1] < [2]", "cannot compare lists"},
+		{"hour in [1, 'a']", "lists must contain string or number literals of one type"},
+		{"(hour > 6", `expected ")"`},
+		{"hour > 6 6", `unexpected "6"`},
+		{"weekday == 'sat", "unterminated string"},
+		{"hour # 6", "unexpected character '#'"},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.src, func(t *testing.T) {
+			_, err := Compile(tc.src, testEnv)
+			require.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestMissingValue(t *testing.T) {
+	r := require.New(t)
+	p, err := Compile("hour > 6", testEnv)
+	r.NoError(err)
+
+	_, err = p.Eval(Values{})
+	r.ErrorContains(err, "missing value for hour")
+
+	_, err = p.Eval(Values{"hour": "seven"})
+	r.ErrorContains(err, "missing value for hour")
+}
+
+func TestEvalPanics(t *testing.T) {
+	// Only evaluation errors are recovered; anything else is a bug.
+	p := &Program{root: &notNode{x: &literalNode{t: Bool, v: 1}}}
+	require.Panics(t, func() { _, _ = p.Eval(Values{}) })
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package expr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	pos  int
+	text string  // Identifier, operator, or string value.
+	num  float64 // Numeric value.
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return strconv.Quote(t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+// operators are matched longest-first.
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "..", "!", "<", ">", "(", ")", "[", "]", ",", "-"}
+
+// lex splits the source into tokens.
+func lex(src string) ([]token, error) {
+	var ret []token
+	pos := 0
+	for pos < len(src) {
+		c := rune(src[pos])
+		switch {
+		case unicode.IsSpace(c):
+			pos++
+
+		case c >= '0' && c <= '9':
+			start := pos
+			for pos < len(src) && src[pos] >= '0' && src[pos] <= '9' {
+				pos++
+			}
+			// Don't consume the start of a range operator.
+			if pos+1 < len(src) && src[pos] == '.' && src[pos+1] != '.' {
+				pos++
+				for pos < len(src) && src[pos] >= '0' && src[pos] <= '9' {
+					pos++
+				}
+			}
+			num, err := strconv.ParseFloat(src[start:pos], 64)
+			if err != nil {
+				return nil, fmt.Errorf("offset %d: invalid number %q", start, src[start:pos])
+			}
+			ret = append(ret, token{kind: tokNumber, pos: start, text: src[start:pos], num: num})
+
+		case c == '"' || c == '\'':
+			start := pos
+			end := strings.IndexByte(src[pos+1:], byte(c))
+			if end < 0 {
+				return nil, fmt.Errorf("offset %d: unterminated string", start)
+			}
+			pos += end + 2
+			ret = append(ret, token{kind: tokString, pos: start, text: src[start+1 : pos-1]})
+
+		case isIdent(c, false):
+			start := pos
+			for pos < len(src) && isIdent(rune(src[pos]), true) {
+				pos++
+			}
+			ret = append(ret, token{kind: tokIdent, pos: start, text: src[start:pos]})
+
+		default:
+			found := ""
+			for _, op := range operators {
+				if strings.HasPrefix(src[pos:], op) {
+					found = op
+					break
+				}
+			}
+			if found == "" {
+				return nil, fmt.Errorf("offset %d: unexpected character %q", pos, c)
+			}
+			ret = append(ret, token{kind: tokOp, pos: pos, text: found})
+			pos += len(found)
+		}
+	}
+	return append(ret, token{kind: tokEOF, pos: pos}), nil
+}
+
+// isIdent returns true if the character may appear in an identifier. Dotted
+// names, such as "cmd.write", are a single identifier.
+func isIdent(c rune, inner bool) bool {
+	switch {
+	case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		return true
+	case inner && (c == '.' || c >= '0' && c <= '9'):
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package expr
+
+import (
+	"fmt"
+	"slices"
+)
+
+// A node is an element of a type-checked expression tree. The value returned
+// by eval is a bool, float64, string, []string, or []float64 as indicated by
+// the node's type.
+type node interface {
+	eval(v Values) any
+	typ() Type
+}
+
+type literalNode struct {
+	t Type
+	v any
+}
+
+func (n *literalNode) eval(Values) any { return n.v }
+func (n *literalNode) typ() Type       { return n.t }
+
+type identNode struct {
+	name string
+	t    Type
+}
+
+func (n *identNode) eval(v Values) any {
+	found, ok := v[n.name]
+	if ok {
+		switch n.t {
+		case Bool:
+			_, ok = found.(bool)
+		case Number:
+			_, ok = found.(float64)
+		case String:
+			_, ok = found.(string)
+		case StringList:
+			_, ok = found.([]string)
+		}
+	}
+	if !ok {
+		panic(missing(n.name))
+	}
+	return found
+}
+func (n *identNode) typ() Type { return n.t }
+
+type logicNode struct {
+	and  bool
+	l, r node
+}
+
+func (n *logicNode) eval(v Values) any {
+	l := n.l.eval(v).(bool)
+	if l != n.and {
+		return l
+	}
+	return n.r.eval(v).(bool)
+}
+func (n *logicNode) typ() Type { return Bool }
+
+type notNode struct{ x node }
+
+func (n *notNode) eval(v Values) any { return !n.x.eval(v).(bool) }
+func (n *notNode) typ() Type         { return Bool }
+
+type negNode struct{ x node }
+
+func (n *negNode) eval(v Values) any { return -n.x.eval(v).(float64) }
+func (n *negNode) typ() Type         { return Number }
+
+type compareNode struct {
+	op   string
+	l, r node
+}
+
+func (n *compareNode) eval(v Values) any {
+	l, r := n.l.eval(v), n.r.eval(v)
+	switch n.op {
+	case "==":
+		return l == r
+	case "!=":
+		return l != r
+	}
+	a, b := l.(float64), r.(float64)
+	switch n.op {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	default:
+		panic(fmt.Sprintf("unknown operator %s", n.op))
+	}
+}
+func (n *compareNode) typ() Type { return Bool }
+
+type rangeNode struct{ x, lo, hi node }
+
+func (n *rangeNode) eval(v Values) any {
+	x := n.x.eval(v).(float64)
+	return n.lo.eval(v).(float64) <= x && x <= n.hi.eval(v).(float64)
+}
+func (n *rangeNode) typ() Type { return Bool }
+
+type inNode struct{ x, list node }
+
+func (n *inNode) eval(v Values) any {
+	switch list := n.list.eval(v).(type) {
+	case []string:
+		return slices.Contains(list, n.x.eval(v).(string))
+	case []float64:
+		return slices.Contains(list, n.x.eval(v).(float64))
+	default:
+		panic(fmt.Sprintf("unexpected list type %T", list))
+	}
+}
+func (n *inNode) typ() Type { return Bool }
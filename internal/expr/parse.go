@@ -0,0 +1,254 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package expr
+
+import (
+	"fmt"
+	"slices"
+)
+
+type parser struct {
+	env  Env
+	pos  int
+	toks []token
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) peek() token { return p.toks[p.pos] }
+
+// accept consumes the next token if it is the operator or keyword.
+func (p *parser) accept(text string) bool {
+	if t := p.peek(); (t.kind == tokOp || t.kind == tokIdent) && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		t := p.peek()
+		return fmt.Errorf("offset %d: expected %q, found %s", t.pos, text, t)
+	}
+	return nil
+}
+
+func (p *parser) parse() (node, error) {
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("offset %d: unexpected %s", t.pos, t)
+	}
+	return n, nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	return p.parseLogic("||", p.parseAnd)
+}
+
+func (p *parser) parseAnd() (node, error) {
+	return p.parseLogic("&&", p.parseNot)
+}
+
+func (p *parser) parseLogic(op string, operand func() (node, error)) (node, error) {
+	l, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		pos := p.peek().pos
+		if !p.accept(op) {
+			return l, nil
+		}
+		r, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		if l.typ() != Bool || r.typ() != Bool {
+			return nil, fmt.Errorf("offset %d: %s requires bool operands", pos, op)
+		}
+		l = &logicNode{and: op == "&&", l: l, r: r}
+	}
+}
+
+func (p *parser) parseNot() (node, error) {
+	pos := p.peek().pos
+	if !p.accept("!") {
+		return p.parseCompare()
+	}
+	x, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	if x.typ() != Bool {
+		return nil, fmt.Errorf("offset %d: ! requires a bool operand", pos)
+	}
+	return &notNode{x: x}, nil
+}
+
+var compareOps = []string{"==", "!=", "<", "<=", ">", ">="}
+
+func (p *parser) parseCompare() (node, error) {
+	l, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	switch {
+	case t.kind == tokOp && slices.Contains(compareOps, t.text):
+		p.next()
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if l.typ() != r.typ() {
+			return nil, fmt.Errorf("offset %d: cannot compare %s with %s", t.pos, l.typ(), r.typ())
+		}
+		if l.typ() == StringList || l.typ() == numberList {
+			return nil, fmt.Errorf("offset %d: cannot compare lists", t.pos)
+		}
+		if l.typ() != Number && t.text != "==" && t.text != "!=" {
+			return nil, fmt.Errorf("offset %d: %s requires number operands", t.pos, t.text)
+		}
+		return &compareNode{op: t.text, l: l, r: r}, nil
+
+	case t.kind == tokIdent && t.text == "in":
+		p.next()
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if p.accept("..") {
+			hi, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			if l.typ() != Number || r.typ() != Number || hi.typ() != Number {
+				return nil, fmt.Errorf("offset %d: ranges require number operands", t.pos)
+			}
+			return &rangeNode{x: l, lo: r, hi: hi}, nil
+		}
+		switch {
+		case l.typ() == String && r.typ() == StringList,
+			l.typ() == Number && r.typ() == numberList:
+			return &inNode{x: l, list: r}, nil
+		default:
+			return nil, fmt.Errorf("offset %d: cannot test %s in %s", t.pos, l.typ(), r.typ())
+		}
+	}
+	return l, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	pos := p.peek().pos
+	if !p.accept("-") {
+		return p.parsePrimary()
+	}
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	if x.typ() != Number {
+		return nil, fmt.Errorf("offset %d: - requires a number operand", pos)
+	}
+	return &negNode{x: x}, nil
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		return &literalNode{t: Number, v: t.num}, nil
+	case tokString:
+		return &literalNode{t: String, v: t.text}, nil
+	case tokIdent:
+		switch t.text {
+		case "true", "false":
+			return &literalNode{t: Bool, v: t.text == "true"}, nil
+		case "in":
+			return nil, fmt.Errorf("offset %d: unexpected %s", t.pos, t)
+		}
+		typ, ok := p.env[t.text]
+		if !ok {
+			return nil, fmt.Errorf("offset %d: unknown name %q", t.pos, t.text)
+		}
+		return &identNode{name: t.text, t: typ}, nil
+	case tokOp:
+		switch t.text {
+		case "(":
+			n, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expect(")")
+		case "[":
+			return p.parseList(t)
+		}
+	}
+	return nil, fmt.Errorf("offset %d: unexpected %s", t.pos, t)
+}
+
+// parseList parses the remainder of a list literal. The elements must all be
+// string or number literals.
+func (p *parser) parseList(open token) (node, error) {
+	var strs []string
+	var nums []float64
+	for !p.accept("]") {
+		if len(strs)+len(nums) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		lit, ok := n.(*literalNode)
+		if neg, isNeg := n.(*negNode); isNeg {
+			if l, isLit := neg.x.(*literalNode); isLit {
+				lit, ok = &literalNode{t: Number, v: -l.v.(float64)}, true
+			}
+		}
+		switch {
+		case ok && lit.t == String && len(nums) == 0:
+			strs = append(strs, lit.v.(string))
+		case ok && lit.t == Number && len(strs) == 0:
+			nums = append(nums, lit.v.(float64))
+		default:
+			return nil, fmt.Errorf("offset %d: lists must contain string or number literals of one type", open.pos)
+		}
+	}
+	if len(nums) > 0 {
+		return &literalNode{t: numberList, v: nums}, nil
+	}
+	return &literalNode{t: StringList, v: strs}, nil
+}
@@ -32,7 +32,9 @@ import (
 	"vawter.tech/stopper/linger"
 )
 
-func NewStopperForTest(t *testing.T) *stopper.Context {
+// NewStopperForTest returns a stopper that will be stopped and checked for
+// lingering goroutines when the test completes.
+func NewStopperForTest(t testing.TB) *stopper.Context {
 	const grace = 5 * time.Second
 	const timeout = 30 * time.Second
 
@@ -0,0 +1,245 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"vawter.tech/stopper"
+)
+
+// errAdminForbidden is returned when a principal may not change the state of
+// the proxy.
+var errAdminForbidden = errors.New("principal may not use this endpoint")
+
+// Admin configures the administrative HTTP interface. Requests are
+// authenticated as a principal, using HTTP basic authentication with one of
+// the principal's tokens, or with a TLS client certificate. Basic
+// authentication is only accepted if TLS is enabled.
+type Admin struct {
+	// Addr is the address on which the interface listens.
+	Addr netip.AddrPort `json:"addr"`
+	// Principals lists the principals, or groups with a "group:" prefix,
+	// which may change the state of the proxy, such as by deciding on a
+	// pending write, lifting a ban, or setting a mode. No principal may do
+	// so if empty.
+	Principals []string `json:"principals"`
+	// TLS enables HTTPS for the interface.
+	TLS *TLS `json:"tls"`
+}
+
+// An adminServer is a running admin interface.
+type adminServer struct {
+	addr  netip.AddrPort
+	local net.Addr // The bound address.
+	srv   *http.Server
+	tls   bool
+}
+
+// matches returns true if the server can continue to serve the
+// configuration.
+func (s *adminServer) matches(a *Admin) bool {
+	return s.addr == a.Addr && s.tls == (a.TLS != nil)
+}
+
+// serveAdmin starts the admin interface. TLS settings are taken from the
+// active configuration when each connection is made, so certificates may be
+// changed without restarting the server.
+func (p *Proxy) serveAdmin(ctx *stopper.Context, a *Admin) (*adminServer, error) {
+	var l net.Listener
+	l, err := net.ListenTCP("tcp", net.TCPAddrFromAddrPort(a.Addr))
+	if err != nil {
+		return nil, err
+	}
+	if a.TLS != nil {
+		l = tls.NewListener(l, &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				if a := p.config().Admin; a != nil && a.TLS != nil {
+					return a.TLS.config, nil
+				}
+				return nil, errors.New("admin tls not configured")
+			},
+		})
+	}
+
+	ret := &adminServer{
+		addr:  a.Addr,
+		local: l.Addr(),
+		srv: &http.Server{
+			BaseContext:       func(net.Listener) context.Context { return ctx },
+			Handler:           p.adminHandler(),
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+		tls: a.TLS != nil,
+	}
+	ctx.Go(func(ctx *stopper.Context) error {
+		if err := ret.srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+			slog.ErrorContext(ctx, "admin interface stopped", slog.Any("error", err))
+		}
+		return nil
+	})
+	slog.DebugContext(ctx, "admin interface listening", slog.Any("addr", ret.local))
+	return ret, nil
+}
+
+// adminHandler returns the routes of the admin interface.
+func (p *Proxy) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /approvals", p.adminAuth(func(w http.ResponseWriter, _ *http.Request, _ *principal) {
+		writeJSON(w, http.StatusOK, p.approvals.list())
+	}))
+	decide := func(approve bool) http.HandlerFunc {
+		return p.adminPrivileged(func(w http.ResponseWriter, r *http.Request, who *principal) {
+			pending, err := p.decide(r.Context(), r.PathValue("id"), who, approve)
+			switch {
+			case errors.Is(err, errApprovalNotFound):
+				http.Error(w, err.Error(), http.StatusNotFound)
+			case err != nil:
+				http.Error(w, err.Error(), http.StatusForbidden)
+			default:
+				writeJSON(w, http.StatusOK, pending)
+			}
+		})
+	}
+	mux.HandleFunc("POST /approvals/{id}/approve", decide(true))
+	mux.HandleFunc("POST /approvals/{id}/reject", decide(false))
+	mux.HandleFunc("GET /bans", p.adminAuth(func(w http.ResponseWriter, _ *http.Request, _ *principal) {
+		writeJSON(w, http.StatusOK, p.bans.list())
+	}))
+	mux.HandleFunc("DELETE /bans/{client}", p.adminPrivileged(func(w http.ResponseWriter, r *http.Request, who *principal) {
+		client, err := netip.ParseAddr(r.PathValue("client"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := p.bans.clear(r.Context(), client.Unmap(), who); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("GET /mode", p.adminAuth(func(w http.ResponseWriter, r *http.Request, _ *principal) {
+		writeJSON(w, http.StatusOK, p.modeStatus(r.Context()))
+	}))
+	setMode := func(w http.ResponseWriter, r *http.Request, who *principal, mode Mode) {
+		if err := mode.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hostname := r.URL.Query().Get("target")
+		if _, ok := p.config().Targets[hostname]; hostname != "" && !ok {
+			http.Error(w, "unknown target", http.StatusNotFound)
+			return
+		}
+		p.modes.set(hostname, mode)
+		slog.LogAttrs(r.Context(), slog.LevelWarn, "mode changed",
+			slog.Bool("audit", true),
+			slog.String("mode", string(mode)),
+			slog.String("target", hostname),
+			slog.Any("principal", who))
+		writeJSON(w, http.StatusOK, p.modeStatus(r.Context()))
+	}
+	mux.HandleFunc("PUT /mode/{mode}", p.adminPrivileged(func(w http.ResponseWriter, r *http.Request, who *principal) {
+		mode := Mode(r.PathValue("mode"))
+		if mode == "" {
+			http.Error(w, "mode required", http.StatusBadRequest)
+			return
+		}
+		setMode(w, r, who, mode)
+	}))
+	mux.HandleFunc("DELETE /mode", p.adminPrivileged(func(w http.ResponseWriter, r *http.Request, who *principal) {
+		setMode(w, r, who, "")
+	}))
+	return mux
+}
+
+// adminAuth authenticates a request to the admin interface as a principal.
+func (p *Proxy) adminAuth(
+	fn func(w http.ResponseWriter, r *http.Request, who *principal),
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := netip.ParseAddrPort(r.RemoteAddr)
+		if err != nil {
+			http.Error(w, "invalid remote address", http.StatusBadRequest)
+			return
+		}
+
+		creds := &credentials{}
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			creds.identities = certIdentities(r.TLS.PeerCertificates[0])
+		}
+		// Tokens are not accepted in plaintext.
+		user, token, hasToken := r.BasicAuth()
+		if hasToken && r.TLS == nil {
+			auditReject(r.Context(), slog.With(slog.Any("client", client), slog.Bool("admin", true)),
+				rejectAuthPlaintext, slog.String("user", user))
+			http.Error(w, "basic authentication requires tls", http.StatusUnauthorized)
+			return
+		}
+		if hasToken {
+			creds.name = user
+			creds.digest = sha256.Sum256([]byte(token))
+		}
+
+		who, ok := p.config().authenticate(creds, client.Addr().Unmap())
+		if !ok {
+			auditReject(r.Context(), slog.With(slog.Any("client", client), slog.Bool("admin", true)),
+				rejectAuth, slog.String("user", user))
+			w.Header().Set("WWW-Authenticate", `Basic realm="mdcmux"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		fn(w, r, who)
+	}
+}
+
+// adminPrivileged authenticates a request which changes the state of the
+// proxy. The principal must be listed in the admin configuration.
+func (p *Proxy) adminPrivileged(
+	fn func(w http.ResponseWriter, r *http.Request, who *principal),
+) http.HandlerFunc {
+	return p.adminAuth(func(w http.ResponseWriter, r *http.Request, who *principal) {
+		if a := p.config().Admin; a == nil || !who.listed(a.Principals) {
+			auditReject(r.Context(), slog.With(slog.String("client", r.RemoteAddr), slog.Bool("admin", true)),
+				rejectAdminForbidden, slog.Any("principal", who), slog.String("path", r.URL.Path))
+			http.Error(w, errAdminForbidden.Error(), http.StatusForbidden)
+			return
+		}
+		fn(w, r, who)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(data)
+}
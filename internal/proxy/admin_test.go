@@ -0,0 +1,126 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/netip"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"vawter.tech/mdcmux/internal/mdctest"
+	"vawter.tech/mdcmux/pkg/dummy"
+	"vawter.tech/notify"
+)
+
+func TestAdminAuth(t *testing.T) {
+	r := require.New(t)
+
+	ctx := mdctest.NewStopperForTest(t)
+
+	d, err := dummy.New(ctx, "127.0.0.1:0")
+	r.NoError(err)
+
+	cfg := notify.VarOf(&Config{
+		Admin: &Admin{
+			Addr:       netip.MustParseAddrPort("127.0.0.1:0"),
+			Principals: []string{"alice"},
+		},
+		Bind: netip.AddrFrom4([4]byte{127, 0, 0, 1}),
+		Principals: map[string]*Principal{
+			"alice": {Tokens: []string{HashToken("alice")}},
+		},
+		Targets: map[string]*Target{
+			d.Addr().String(): {},
+		},
+	})
+	p, _ := startProxy(t, ctx, cfg)
+
+	p.mu.RLock()
+	adminURL := "http://" + p.mu.admin.local.String()
+	p.mu.RUnlock()
+
+	// Tokens are refused without TLS.
+	req, err := http.NewRequestWithContext(ctx, "PUT", adminURL+"/mode/read-only", nil)
+	r.NoError(err)
+	req.SetBasicAuth("alice", "alice")
+	resp, err := http.DefaultClient.Do(req)
+	r.NoError(err)
+	_ = resp.Body.Close()
+	r.Equal(http.StatusUnauthorized, resp.StatusCode)
+	r.Equal(ModeNormal, p.modeStatus(ctx).Global)
+}
+
+// testAdmin returns the configuration of an HTTPS admin interface on a local
+// port and a pool which trusts its certificate. The listed principals may
+// change the state of the proxy.
+func testAdmin(t *testing.T, principals ...string) (*Admin, *x509.CertPool) {
+	dir := t.TempDir()
+	ca, caKey := testCert(t, dir, "ca", nil, nil)
+	testCert(t, dir, "server", ca, caKey)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	return &Admin{
+		Addr:       netip.MustParseAddrPort("127.0.0.1:0"),
+		Principals: principals,
+		TLS: &TLS{
+			Cert: filepath.Join(dir, "server.crt"),
+			Key:  filepath.Join(dir, "server.key"),
+		},
+	}, roots
+}
+
+// adminClient returns a function which sends a request to the proxy's admin
+// interface as a principal, using the principal's name as its token. No
+// credentials are sent if the principal is empty.
+func adminClient(
+	t *testing.T, p *Proxy, roots *x509.CertPool,
+) func(method, path, user string) (int, []byte) {
+	p.mu.RLock()
+	adminURL := "https://" + p.mu.admin.local.String()
+	p.mu.RUnlock()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+	t.Cleanup(client.CloseIdleConnections)
+
+	return func(method, path, user string) (int, []byte) {
+		r := require.New(t)
+		req, err := http.NewRequestWithContext(t.Context(), method, adminURL+path, nil)
+		r.NoError(err)
+		if user != "" {
+			req.SetBasicAuth(user, user)
+		}
+		resp, err := client.Do(req)
+		r.NoError(err)
+		defer func() { _ = resp.Body.Close() }()
+		body, err := io.ReadAll(resp.Body)
+		r.NoError(err)
+		return resp.StatusCode, body
+	}
+}
@@ -0,0 +1,378 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"vawter.tech/mdcmux/pkg/message"
+	"vawter.tech/stopper"
+)
+
+// defaultApprovalExpiry is the length of time for which a write will wait for
+// approval if the client does not wait for the decision.
+const defaultApprovalExpiry = 15 * time.Minute
+
+// Outcomes of a write which required approval.
+const (
+	outcomeDenied     = "denied"
+	outcomeError      = "error"
+	outcomeExecuted   = "executed"
+	outcomeExpired    = "expired"
+	outcomeRejected   = "rejected"
+	outcomeUnverified = "unverified"
+)
+
+// denyTargetChanged is reported when the listener of a pending write has been
+// moved to another target.
+const denyTargetChanged = "target changed"
+
+// Errors returned when deciding on a pending write.
+var (
+	errApprovalNotFound = errors.New("no such pending write")
+	errSelfApproval     = errors.New("a write may not be approved by its requester")
+	errNotApprover      = errors.New("principal may not approve the write")
+)
+
+// An Approval holds writes to a range of macro variables until a second
+// principal approves them through the admin interface.
+type Approval struct {
+	// Approvers lists the principals, or groups with a "group:" prefix,
+	// which may decide on a write. Deciders must also be listed in the
+	// admin configuration's principals. Any of those principals other than
+	// the requester may decide if empty.
+	Approvers []string `json:"approvers"`
+	// Expire is the length of time for which a write waits for a decision
+	// when the client does not wait. Defaults to 15 minutes.
+	Expire time.Duration `json:"expire"`
+	// Variables is an inclusive range of macro variable numbers.
+	Variables [2]int `json:"variables"`
+	// Wait causes the client to wait for up to the given length of time for
+	// a decision. Otherwise, the client receives an immediate reply with an
+	// identifier for the pending write. A write for which no decision is
+	// made in time is discarded.
+	Wait time.Duration `json:"wait"`
+}
+
+// allows returns true if the principal may decide on writes.
+func (a *Approval) allows(who *principal) bool {
+	return len(a.Approvers) == 0 || who.listed(a.Approvers)
+}
+
+// expiry returns the length of time for which a write may be pending.
+func (a *Approval) expiry() time.Duration {
+	switch {
+	case a.Wait > 0:
+		return a.Wait
+	case a.Expire > 0:
+		return a.Expire
+	default:
+		return defaultApprovalExpiry
+	}
+}
+
+func (a *Approval) validate() error {
+	if a.Variables[0] > a.Variables[1] {
+		return fmt.Errorf("invalid variable range %v", a.Variables)
+	}
+	if a.Expire < 0 || a.Wait < 0 {
+		return errors.New("durations must not be negative")
+	}
+	return nil
+}
+
+// approvalFor returns the first approval which matches the command, if it is
+// a write.
+func (p *Policy) approvalFor(cmd message.Command) *Approval {
+	if !cmd.IsWrite() {
+		return nil
+	}
+	v, _ := cmd.Variable()
+	variable := int(v.Whole())
+	for _, approval := range p.Approvals {
+		if approval.Variables[0] <= variable && variable <= approval.Variables[1] {
+			return approval
+		}
+	}
+	return nil
+}
+
+// A pendingWrite is a write which is waiting for a decision.
+type pendingWrite struct {
+	Approver  string     `json:"approver,omitempty"`
+	Client    netip.Addr `json:"client"`
+	Command   string     `json:"command"`
+	Expires   time.Time  `json:"expires"`
+	ID        string     `json:"id"`
+	Outcome   string     `json:"outcome,omitempty"`
+	Principal string     `json:"principal,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	Requested time.Time  `json:"requested"`
+	Response  string     `json:"response,omitempty"`
+	Target    string     `json:"target"`
+
+	approval *Approval
+	binding  *binding
+	cmd      message.Command
+	done     chan struct{} // Closed once the outcome is set.
+	err      error
+	expire   *time.Timer
+	logger   *slog.Logger
+	resp     message.Response
+	router   func() (*binding, bool) // Routes the requesting session.
+	session  string
+}
+
+// approvalQueue contains writes which are waiting for a decision.
+type approvalQueue struct {
+	mu      sync.Mutex
+	pending map[string]*pendingWrite
+}
+
+// add enqueues a write. The write will expire if no decision is made.
+func (q *approvalQueue) add(w *pendingWrite) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending == nil {
+		q.pending = make(map[string]*pendingWrite)
+	}
+	for {
+		w.ID = randomID()
+		if _, dup := q.pending[w.ID]; !dup {
+			break
+		}
+	}
+	q.pending[w.ID] = w
+	w.expire = time.AfterFunc(time.Until(w.Expires), func() {
+		if q.remove(w.ID) != nil {
+			w.finish(context.Background(), outcomeExpired, "")
+		}
+	})
+}
+
+// list returns copies of the pending writes, oldest first.
+func (q *approvalQueue) list() []pendingWrite {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ret := make([]pendingWrite, 0, len(q.pending))
+	for _, w := range q.pending {
+		ret = append(ret, *w)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Requested.Before(ret[j].Requested)
+	})
+	return ret
+}
+
+// remove dequeues the write, returning nil if it is no longer pending.
+func (q *approvalQueue) remove(id string) *pendingWrite {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	w := q.pending[id]
+	if w != nil {
+		delete(q.pending, id)
+		w.expire.Stop()
+	}
+	return w
+}
+
+// take dequeues the write if the principal may decide on it.
+func (q *approvalQueue) take(id string, who *principal) (*pendingWrite, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	w := q.pending[id]
+	switch {
+	case w == nil:
+		return nil, errApprovalNotFound
+	case w.binding.who != nil && w.binding.who.name == who.name:
+		return nil, errSelfApproval
+	case !w.approval.allows(who):
+		return nil, errNotApprover
+	}
+	delete(q.pending, id)
+	w.expire.Stop()
+	w.Approver = who.name
+	return w, nil
+}
+
+// finish records the outcome of the write and wakes any waiting client.
+func (w *pendingWrite) finish(ctx context.Context, outcome, reason string) {
+	w.Outcome = outcome
+	w.Reason = reason
+	if w.resp != nil {
+		w.Response = strings.TrimSpace(w.resp.String())
+	}
+	attrs := []slog.Attr{
+		slog.Bool("audit", true),
+		slog.String("approval", w.ID),
+		slog.Any("request", w.cmd),
+		slog.String("outcome", outcome),
+	}
+	if w.Approver != "" {
+		attrs = append(attrs, slog.String("approver", w.Approver))
+	}
+	if reason != "" {
+		attrs = append(attrs, slog.String("reason", reason))
+	}
+	if w.resp != nil {
+		attrs = append(attrs, slog.Any("response", w.resp))
+	}
+	level := slog.LevelInfo
+	if outcome == outcomeError {
+		level = slog.LevelError
+	}
+	w.logger.LogAttrs(ctx, level, "pending write "+outcome, attrs...)
+	close(w.done)
+}
+
+// decide approves or rejects a pending write on behalf of a principal. An
+// approved write is checked against the current configuration, mode, policy,
+// and machine state before being sent to the MDC host.
+func (p *Proxy) decide(
+	ctx context.Context, id string, who *principal, approve bool,
+) (*pendingWrite, error) {
+	w, err := p.approvals.take(id, who)
+	if err != nil {
+		return nil, err
+	}
+	if !approve {
+		w.finish(ctx, outcomeRejected, "")
+		return w, nil
+	}
+
+	// The configuration may have changed while the write was pending.
+	b, ok := w.router()
+	switch {
+	case !ok:
+		w.finish(ctx, outcomeDenied, denyNoPolicy)
+		return w, nil
+	case b.mdc.Addr() != w.Target:
+		w.finish(ctx, outcomeDenied, denyTargetChanged)
+		return w, nil
+	}
+	switch p.modeFor(ctx, b.mdc.Addr(), b.target) {
+	case ModeOffline:
+		w.finish(ctx, outcomeDenied, denyOffline)
+		return w, nil
+	case ModeReadOnly:
+		w.finish(ctx, outcomeDenied, denyReadOnly)
+		return w, nil
+	}
+	state := p.machineState(b.mdc)
+	if ok, reason := b.policy.Allow(ctx, b.request(w.cmd, state)); !ok {
+		w.finish(ctx, outcomeDenied, reason)
+		return w, nil
+	}
+	if reason := p.journalWrite(ctx, w.logger, b, w.session, w.cmd); reason != "" {
+		w.err = errors.New(reason)
+		w.finish(ctx, outcomeError, reason)
+		return w, nil
+	}
+	w.resp, w.err = b.backend.RoundTrip(ctx, w.cmd)
+	state.reset()
+	if w.err != nil {
+		w.finish(ctx, outcomeError, w.err.Error())
+		return w, nil
+	}
+	if !verifyWrite(ctx, w.logger, b, w.cmd, w.resp) {
+		w.finish(ctx, outcomeUnverified, "")
+		return w, nil
+	}
+	w.finish(ctx, outcomeExecuted, "")
+	return w, nil
+}
+
+// hold places a write in the approval queue. The client either receives an
+// identifier for the pending write or waits for the outcome.
+func (p *Proxy) hold(
+	ctx *stopper.Context,
+	sess *session,
+	logger *slog.Logger,
+	b *binding,
+	msg message.Command,
+	approval *Approval,
+) (bool, error) {
+	out := sess.out
+	now := time.Now()
+	w := &pendingWrite{
+		Client:    b.client,
+		Command:   strings.TrimSpace(msg.String()),
+		Expires:   now.Add(approval.expiry()),
+		Requested: now,
+		Target:    b.mdc.Addr(),
+
+		approval: approval,
+		binding:  b,
+		cmd:      msg,
+		done:     make(chan struct{}),
+		logger:   logger,
+		router:   sess.router,
+		session:  sess.id,
+	}
+	if b.who != nil {
+		w.Principal = b.who.name
+	}
+	p.approvals.add(w)
+	logger.LogAttrs(ctx, slog.LevelInfo, "pending write",
+		slog.Bool("audit", true),
+		slog.String("approval", w.ID),
+		slog.Any("request", msg))
+
+	if approval.Wait == 0 {
+		return true, message.WriteResponse(out, "?, MDCMUX PENDING %s", w.ID)
+	}
+	// The outcome will be set by a decision or by the expiry timer.
+	select {
+	case <-w.done:
+	case <-ctx.Stopping():
+		if p.approvals.remove(w.ID) != nil {
+			w.finish(ctx, outcomeExpired, "proxy stopping")
+			return false, nil
+		}
+		<-w.done
+	}
+
+	switch w.Outcome {
+	case outcomeExecuted:
+		return true, writeProxied(out, w.resp)
+	case outcomeDenied:
+		return true, message.WriteResponse(out, "?, MDCMUX DENY POLICY")
+	case outcomeError:
+		_ = message.WriteResponse(out, "?, MDCMUX PROXY ERROR")
+		return false, w.err
+	case outcomeRejected:
+		return true, message.WriteResponse(out, "?, MDCMUX REJECTED")
+	case outcomeUnverified:
+		return true, message.WriteResponse(out, "?, MDCMUX VERIFY FAILED")
+	default:
+		return true, message.WriteResponse(out, "?, MDCMUX APPROVAL TIMEOUT")
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"vawter.tech/mdcmux/internal/mdctest"
+	"vawter.tech/mdcmux/pkg/dummy"
+	"vawter.tech/mdcmux/pkg/message"
+	"vawter.tech/notify"
+)
+
+func TestApproval(t *testing.T) {
+	r := require.New(t)
+
+	ctx := mdctest.NewStopperForTest(t)
+
+	d, err := dummy.New(ctx, "127.0.0.1:0")
+	r.NoError(err)
+
+	adminCfg, roots := testAdmin(t, "alice", "bob", "carol")
+	newConfig := func(writes [2]int) *Config {
+		return &Config{
+			Admin: adminCfg,
+			Bind:  netip.AddrFrom4([4]byte{127, 0, 0, 1}),
+			Policy: map[netip.Prefix]*Policy{
+				netip.MustParsePrefix("127.0.0.1/32"): {
+					AllowWrites: [][2]int{writes},
+					Approvals: []*Approval{
+						{Variables: [2]int{10, 19}, Approvers: []string{"group:leads"}},
+						{Variables: [2]int{20, 29}, Wait: time.Minute},
+					},
+				},
+			},
+			Principals: map[string]*Principal{
+				"alice": {Tokens: []string{HashToken("alice")}},
+				"bob":   {Groups: []string{"leads"}, Tokens: []string{HashToken("bob")}},
+				"carol": {Tokens: []string{HashToken("carol")}},
+			},
+			Targets: map[string]*Target{
+				d.Addr().String(): {},
+			},
+		}
+	}
+	cfg := notify.VarOf(newConfig([2]int{1, 100}))
+	p, pConn := startProxy(t, ctx, cfg)
+
+	admin := adminClient(t, p, roots)
+	pending := func() []*pendingWrite {
+		code, body := admin("GET", "/approvals", "carol")
+		r.Equal(http.StatusOK, code)
+		var ret []*pendingWrite
+		r.NoError(json.Unmarshal(body, &ret))
+		return ret
+	}
+	read := func(v int) string {
+		resp, err := pConn.RoundTrip(ctx, message.QueryCommand(message.Int(v)))
+		r.NoError(err)
+		return resp.String()
+	}
+
+	sess := dialSession(t, pConn.Addr())
+	send := sess.send
+	r.Equal("!", send("?XAUTH alice alice"))
+
+	// Writes outside of the approval ranges are unaffected.
+	r.Equal("!", send("?E5 1"))
+
+	reply := send("?E10 1.5")
+	id, ok := strings.CutPrefix(reply, "?, MDCMUX PENDING ")
+	r.True(ok, reply)
+	before := read(10)
+
+	list := pending()
+	r.Len(list, 1)
+	r.Equal(id, list[0].ID)
+	r.Equal("alice", list[0].Principal)
+	r.Equal("?E10 1.5", list[0].Command)
+
+	code, _ := admin("POST", "/approvals/"+id+"/approve", "")
+	r.Equal(http.StatusUnauthorized, code)
+	code, _ = admin("POST", "/approvals/"+id+"/approve", "alice")
+	r.Equal(http.StatusForbidden, code)
+	code, _ = admin("POST", "/approvals/"+id+"/approve", "carol")
+	r.Equal(http.StatusForbidden, code)
+	r.Equal(before, read(10))
+
+	code, body := admin("POST", "/approvals/"+id+"/approve", "bob")
+	r.Equal(http.StatusOK, code)
+	var decided pendingWrite
+	r.NoError(json.Unmarshal(body, &decided))
+	r.Equal(outcomeExecuted, decided.Outcome)
+	r.Equal("bob", decided.Approver)
+	r.Contains(read(10), "1.5")
+	r.Empty(pending())
+
+	code, _ = admin("POST", "/approvals/"+id+"/approve", "bob")
+	r.Equal(http.StatusNotFound, code)
+
+	// A rejected write is discarded.
+	id, ok = strings.CutPrefix(send("?E11 2.5"), "?, MDCMUX PENDING ")
+	r.True(ok)
+	code, body = admin("POST", "/approvals/"+id+"/reject", "bob")
+	r.Equal(http.StatusOK, code)
+	r.NoError(json.Unmarshal(body, &decided))
+	r.Equal(outcomeRejected, decided.Outcome)
+	r.NotContains(read(11), "2.5")
+
+	// The client waits for the decision.
+	replies := make(chan string, 1)
+	go func() {
+		_, _ = io.WriteString(sess, "?E20 3.5\r\n")
+		reply, _ := sess.reply()
+		replies <- reply
+	}()
+	r.Eventually(func() bool {
+		list = pending()
+		return len(list) > 0 && list[0].Command == "?E20 3.5"
+	}, 5*time.Second, 10*time.Millisecond)
+	// Any other principal may approve.
+	code, _ = admin("POST", "/approvals/"+list[0].ID+"/approve", "carol")
+	r.Equal(http.StatusOK, code)
+	r.Equal("!", <-replies)
+	r.Contains(read(20), "3.5")
+
+	// approve approves a pending write as bob.
+	approve := func(id string) *pendingWrite {
+		code, body := admin("POST", "/approvals/"+id+"/approve", "bob")
+		r.Equal(http.StatusOK, code)
+		var decided pendingWrite
+		r.NoError(json.Unmarshal(body, &decided))
+		return &decided
+	}
+
+	// Approval does not bypass a maintenance mode.
+	id, ok = strings.CutPrefix(send("?E12 4.5"), "?, MDCMUX PENDING ")
+	r.True(ok)
+	p.modes.set(d.Addr().String(), ModeOffline)
+	denied := approve(id)
+	p.modes.set(d.Addr().String(), "")
+	r.Equal(outcomeDenied, denied.Outcome)
+	r.Equal(denyOffline, denied.Reason)
+	r.NotContains(read(12), "4.5")
+
+	// The write is checked against the configuration in effect when it is
+	// approved.
+	id, ok = strings.CutPrefix(send("?E13 5.5"), "?, MDCMUX PENDING ")
+	r.True(ok)
+	_, reconfigured := p.reconfigured.Get()
+	cfg.Set(newConfig([2]int{1, 9}))
+	<-reconfigured
+	denied = approve(id)
+	r.Equal(outcomeDenied, denied.Outcome)
+	r.Equal(denyWrite, denied.Reason)
+	r.NotContains(read(13), "5.5")
+}
+
+func TestApprovalValidation(t *testing.T) {
+	r := require.New(t)
+
+	newConfig := func(admin *Admin) *Config {
+		return &Config{
+			Admin: admin,
+			Policy: map[netip.Prefix]*Policy{
+				netip.MustParsePrefix("10.0.0.0/8"): {
+					Approvals: []*Approval{{Variables: [2]int{1, 10}}},
+				},
+			},
+		}
+	}
+	r.ErrorContains(newConfig(nil).Expand(), "approvals require admin principals")
+	r.ErrorContains(newConfig(&Admin{}).Expand(), "approvals require admin principals")
+	r.NoError(newConfig(&Admin{Principals: []string{"alice"}}).Expand())
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Reasons reported when a connection or session is rejected.
+const (
+	rejectAdminForbidden = "admin endpoint forbidden"
+	rejectAuth           = "authentication failed"
+	rejectAuthLate       = "authentication after commands"
+	rejectAuthPlaintext  = "basic authentication without tls"
+	rejectBanned         = "client banned"
+	rejectLineTooLong    = "line too long"
+	rejectNoCommand      = "no command received"
+	rejectClientLimit    = "too many sessions from client"
+	rejectHandshake      = "tls handshake failed"
+	rejectSessionLimit   = "too many sessions for target"
+)
+
+// auditReject records a rejected connection or session. Rejections are always
+// logged, regardless of any policy's Audit setting, since they may indicate a
+// misbehaving client.
+func auditReject(ctx context.Context, logger *slog.Logger, reason string, attrs ...slog.Attr) {
+	attrs = append([]slog.Attr{
+		slog.Bool("audit", true),
+		slog.String("reason", reason),
+	}, attrs...)
+	logger.LogAttrs(ctx, slog.LevelWarn, "reject", attrs...)
+}
@@ -0,0 +1,246 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"vawter.tech/stopper"
+)
+
+// Failures which count towards a ban.
+const (
+	failAuth       = "authentication failure"
+	failDenied     = "policy denial"
+	failNoRoute    = "no route for connection"
+	failParseError = "parse error"
+)
+
+// Reasons reported when a ban is lifted.
+const (
+	unbanCleared = "cleared"
+	unbanExpired = "expired"
+)
+
+// banSweepInterval is the period at which stale failure counts are
+// discarded.
+const banSweepInterval = time.Minute
+
+// errBanNotFound is returned when clearing a client which is not banned.
+var errBanNotFound = errors.New("client is not banned")
+
+// Ban configures the automatic banning of clients which repeatedly fail. A
+// banned client may not connect to any target.
+type Ban struct {
+	// Duration is the length of a ban.
+	Duration time.Duration `json:"duration"`
+	// Exempt lists netblocks which are never banned.
+	Exempt []netip.Prefix `json:"exempt"`
+	// Failures is the number of policy denials, parse errors, failed XAUTH
+	// commands, or unroutable connections or commands which cause a client
+	// to be banned.
+	Failures int `json:"failures"`
+	// Window is the length of time in which failures are counted.
+	Window time.Duration `json:"window"`
+}
+
+func (b *Ban) exempt(client netip.Addr) bool {
+	for _, prefix := range b.Exempt {
+		if prefix.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Ban) validate() error {
+	if b.Failures <= 0 {
+		return errors.New("failures must be positive")
+	}
+	if b.Duration <= 0 || b.Window <= 0 {
+		return errors.New("duration and window must be positive")
+	}
+	return nil
+}
+
+// A banEntry records a banned client.
+type banEntry struct {
+	Client  netip.Addr `json:"client"`
+	Expires time.Time  `json:"expires"`
+	Reason  string     `json:"reason"`
+	Since   time.Time  `json:"since"`
+
+	timer *time.Timer
+}
+
+// banList tracks client failures and bans. The zero value is ready for use.
+type banList struct {
+	mu       sync.Mutex
+	bans     map[netip.Addr]*banEntry
+	failures map[netip.Addr]*rateWindow
+}
+
+// banned returns true if the client is currently banned.
+func (l *banList) banned(client netip.Addr) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.bans[client]
+	return ok
+}
+
+// clear lifts the ban on a client.
+func (l *banList) clear(ctx context.Context, client netip.Addr, who *principal) error {
+	l.mu.Lock()
+	entry, ok := l.bans[client]
+	if ok {
+		entry.timer.Stop()
+		delete(l.bans, client)
+	}
+	l.mu.Unlock()
+	if !ok {
+		return errBanNotFound
+	}
+	slog.LogAttrs(ctx, slog.LevelWarn, "unban",
+		slog.Bool("audit", true),
+		slog.Any("client", client),
+		slog.String("reason", unbanCleared),
+		slog.Any("principal", who))
+	return nil
+}
+
+// fail records a failure by the client and bans it once the configured
+// number of failures has been reached.
+func (l *banList) fail(ctx context.Context, cfg *Ban, client netip.Addr, reason string) {
+	if cfg == nil || cfg.exempt(client) {
+		return
+	}
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.bans[client]; ok {
+		return
+	}
+	if l.failures == nil {
+		l.bans = make(map[netip.Addr]*banEntry)
+		l.failures = make(map[netip.Addr]*rateWindow)
+	}
+	w := l.failures[client]
+	if w == nil {
+		w = &rateWindow{}
+		l.failures[client] = w
+	}
+	if w.add(now, cfg.Window) < cfg.Failures {
+		return
+	}
+	delete(l.failures, client)
+
+	entry := &banEntry{
+		Client:  client,
+		Expires: now.Add(cfg.Duration),
+		Reason:  reason,
+		Since:   now,
+	}
+	entry.timer = time.AfterFunc(cfg.Duration, func() {
+		l.mu.Lock()
+		current := l.bans[client] == entry
+		if current {
+			delete(l.bans, client)
+		}
+		l.mu.Unlock()
+		if current {
+			slog.LogAttrs(context.Background(), slog.LevelWarn, "unban",
+				slog.Bool("audit", true),
+				slog.Any("client", client),
+				slog.String("reason", unbanExpired))
+		}
+	})
+	l.bans[client] = entry
+	slog.LogAttrs(ctx, slog.LevelWarn, "ban",
+		slog.Bool("audit", true),
+		slog.Any("client", client),
+		slog.String("reason", reason),
+		slog.Int("failures", cfg.Failures),
+		slog.Time("expires", entry.Expires))
+}
+
+// fail records a failure by the session's client.
+func (p *Proxy) fail(ctx context.Context, sess *session, reason string) {
+	sess.failed = true
+	p.bans.fail(ctx, p.config().Ban, sess.client, reason)
+}
+
+// list returns the current bans, ordered by client address.
+func (l *banList) list() []banEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ret := make([]banEntry, 0, len(l.bans))
+	for _, entry := range l.bans {
+		ret = append(ret, *entry)
+	}
+	slices.SortFunc(ret, func(a, b banEntry) int {
+		return a.Client.Compare(b.Client)
+	})
+	return ret
+}
+
+// sweep discards the failure counts of clients which have not failed within
+// the window. All counts are discarded if banning is disabled.
+func (l *banList) sweep(now time.Time, cfg *Ban) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for client, w := range l.failures {
+		if cfg == nil {
+			delete(l.failures, client)
+		} else if w.prune(now, cfg.Window); len(w.times) == 0 {
+			delete(l.failures, client)
+		}
+	}
+}
+
+// sweepBans periodically discards stale failure counts, rather than doing so
+// for every failure.
+func (p *Proxy) sweepBans(ctx *stopper.Context) {
+	ctx.Go(func(ctx *stopper.Context) error {
+		ticker := time.NewTicker(banSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Stopping():
+				return nil
+			case now := <-ticker.C:
+				var ban *Ban
+				if cfg := p.config(); cfg != nil {
+					ban = cfg.Ban
+				}
+				p.bans.sweep(now, ban)
+			}
+		}
+	})
+}
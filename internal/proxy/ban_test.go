@@ -0,0 +1,256 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"vawter.tech/mdcmux/internal/mdctest"
+	"vawter.tech/mdcmux/pkg/dummy"
+	"vawter.tech/mdcmux/pkg/message"
+	"vawter.tech/notify"
+)
+
+func TestBan(t *testing.T) {
+	r := require.New(t)
+
+	ctx := mdctest.NewStopperForTest(t)
+
+	d, err := dummy.New(ctx, "127.0.0.1:0")
+	r.NoError(err)
+
+	adminCfg, roots := testAdmin(t, "group:ops")
+	cfg := notify.VarOf(&Config{
+		Admin: adminCfg,
+		Ban:   &Ban{Duration: time.Hour, Failures: 3, Window: time.Hour},
+		Bind:  netip.AddrFrom4([4]byte{127, 0, 0, 1}),
+		Policy: map[netip.Prefix]*Policy{
+			netip.MustParsePrefix("127.0.0.1/32"): {
+				AllowReads: [][2]int{{1, 100}},
+			},
+		},
+		Principals: map[string]*Principal{
+			"alice": {Groups: []string{"ops"}, Tokens: []string{HashToken("alice")}},
+			"bob":   {Tokens: []string{HashToken("bob")}},
+		},
+		Targets: map[string]*Target{
+			d.Addr().String(): {},
+		},
+	})
+	p, pConn := startProxy(t, ctx, cfg)
+
+	admin := adminClient(t, p, roots)
+
+	sess := dialSession(t, pConn.Addr())
+	for range 3 {
+		r.Equal("?, MDCMUX DENY POLICY", sess.send("?Q600 500"))
+	}
+
+	// The existing session is dropped without a reply.
+	sess.write("?Q600 1")
+	reply, _ := sess.reply()
+	r.NotContains(reply, "MACRO")
+	_, ok := sess.reply()
+	r.False(ok)
+
+	// New connections are closed immediately.
+	conn, err := net.Dial("tcp", pConn.Addr())
+	r.NoError(err)
+	_, err = conn.Read(make([]byte, 1))
+	r.ErrorIs(err, io.EOF)
+	_ = conn.Close()
+
+	code, body := admin("GET", "/bans", "bob")
+	r.Equal(http.StatusOK, code)
+	var bans []banEntry
+	r.NoError(json.Unmarshal(body, &bans))
+	r.Len(bans, 1)
+	r.Equal(netip.MustParseAddr("127.0.0.1"), bans[0].Client)
+	r.Equal(failDenied, bans[0].Reason)
+
+	// Only listed principals may lift a ban.
+	code, _ = admin("DELETE", "/bans/127.0.0.1", "bob")
+	r.Equal(http.StatusForbidden, code)
+	code, _ = admin("DELETE", "/bans/127.0.0.2", "alice")
+	r.Equal(http.StatusNotFound, code)
+	code, _ = admin("DELETE", "/bans/127.0.0.1", "alice")
+	r.Equal(http.StatusNoContent, code)
+
+	resp, err := pConn.RoundTrip(ctx, message.QueryCommand(message.Int(1)))
+	r.NoError(err)
+	r.True(resp.IsSuccess())
+}
+
+// Failed XAUTH commands and unroutable sessions count towards a ban, even
+// though clients which may authenticate are accepted without a route.
+func TestBanUnauthenticated(t *testing.T) {
+	ctx := mdctest.NewStopperForTest(t)
+
+	d, err := dummy.New(ctx, "127.0.0.1:0")
+	require.NoError(t, err)
+
+	cfg := notify.VarOf(&Config{
+		Ban:  &Ban{Duration: time.Hour, Failures: 3, Window: time.Hour},
+		Bind: netip.AddrFrom4([4]byte{127, 0, 0, 1}),
+		IdentityPolicy: map[string]*Policy{
+			"alice": {},
+		},
+		Principals: map[string]*Principal{
+			"alice": {Tokens: []string{HashToken("alice")}},
+		},
+		Targets: map[string]*Target{
+			d.Addr().String(): {},
+		},
+	})
+	p, pConn := startProxy(t, ctx, cfg)
+	client := netip.MustParseAddr("127.0.0.1")
+
+	// requireBanned checks that new connections are closed immediately and
+	// lifts the ban.
+	requireBanned := func(t *testing.T, reason string) {
+		r := require.New(t)
+		conn, err := net.Dial("tcp", pConn.Addr())
+		r.NoError(err)
+		_, err = conn.Read(make([]byte, 1))
+		r.ErrorIs(err, io.EOF)
+		_ = conn.Close()
+
+		bans := p.bans.list()
+		r.Len(bans, 1)
+		r.Equal(reason, bans[0].Reason)
+		r.NoError(p.bans.clear(ctx, client, nil))
+	}
+
+	t.Run("bad_tokens", func(t *testing.T) {
+		r := require.New(t)
+		// An unauthenticated session is closed after a failed attempt.
+		for range 3 {
+			raw := dialProxy(t, pConn.Addr())
+			_, err := io.WriteString(raw, "?XAUTH alice wrong\r\n")
+			r.NoError(err)
+			buf, err := io.ReadAll(raw)
+			r.NoError(err)
+			r.Equal(">?, MDCMUX AUTH FAILED\r\n>", string(buf))
+		}
+		requireBanned(t, failAuth)
+	})
+
+	t.Run("no_route", func(t *testing.T) {
+		r := require.New(t)
+		// An unauthenticated command is not routed.
+		raw := dialProxy(t, pConn.Addr())
+		_, err := io.WriteString(raw, "?Q600 1\r\n")
+		r.NoError(err)
+		_, err = io.ReadAll(raw)
+		r.NoError(err)
+
+		// Sessions which end without authenticating also count.
+		for range 2 {
+			raw := dialProxy(t, pConn.Addr())
+			r.NoError(raw.Close())
+		}
+		r.Eventually(func() bool { return p.bans.banned(client) }, 5*time.Second, 10*time.Millisecond)
+		requireBanned(t, failNoRoute)
+	})
+
+	t.Run("authenticated", func(t *testing.T) {
+		r := require.New(t)
+		for range 3 {
+			sess := dialSession(t, pConn.Addr())
+			r.Equal("!", sess.send("?XAUTH alice alice"))
+			r.NoError(sess.Close())
+		}
+		time.Sleep(50 * time.Millisecond)
+		r.False(p.bans.banned(client))
+	})
+}
+
+func TestBanExpiry(t *testing.T) {
+	r := require.New(t)
+
+	ctx := mdctest.NewStopperForTest(t)
+	client := netip.MustParseAddr("192.0.2.1")
+	cfg := &Ban{
+		Duration: 50 * time.Millisecond,
+		Exempt:   []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		Failures: 2,
+		Window:   time.Hour,
+	}
+
+	var l banList
+	l.fail(ctx, cfg, client, failParseError)
+	r.False(l.banned(client))
+	l.fail(ctx, cfg, client, failNoRoute)
+	r.True(l.banned(client))
+	r.Eventually(func() bool { return !l.banned(client) }, time.Second, 10*time.Millisecond)
+
+	exempt := netip.MustParseAddr("10.1.1.1")
+	for range 5 {
+		l.fail(ctx, cfg, exempt, failParseError)
+	}
+	r.False(l.banned(exempt))
+
+	// Failure counts are discarded once they leave the window, or if
+	// banning is disabled.
+	l.fail(ctx, cfg, client, failParseError)
+	l.sweep(time.Now(), cfg)
+	r.Len(l.failures, 1)
+	l.sweep(time.Now().Add(2*time.Hour), cfg)
+	r.Empty(l.failures)
+	l.fail(ctx, cfg, client, failParseError)
+	l.sweep(time.Now(), nil)
+	r.Empty(l.failures)
+}
+
+func TestRemoteAddrUnmapped(t *testing.T) {
+	r := require.New(t)
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv6zero})
+	if err != nil {
+		t.Skip("IPv6 is not available:", err)
+	}
+	defer func() { _ = listener.Close() }()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	// An IPv4 client of a dual-stack listener has an IPv4-mapped address.
+	client, err := net.DialTCP("tcp4", nil, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		t.Skip("the listener is not dual-stack:", err)
+	}
+	defer func() { _ = client.Close() }()
+	server, err := listener.AcceptTCP()
+	r.NoError(err)
+	defer func() { _ = server.Close() }()
+
+	r.True(server.RemoteAddr().(*net.TCPAddr).AddrPort().Addr().Is4In6())
+	addr := remoteAddr(server)
+	r.Equal(netip.MustParseAddr("127.0.0.1"), addr.Addr())
+	r.Equal(uint16(client.LocalAddr().(*net.TCPAddr).Port), addr.Port())
+}
@@ -24,87 +24,431 @@ package proxy
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"maps"
 	"net/netip"
 	"slices"
+	"strconv"
 	"time"
 
+	"vawter.tech/mdcmux/internal/expr"
 	"vawter.tech/mdcmux/pkg/message"
 )
 
-const defaultMaxIdle = 5 * time.Minute
+// Reasons reported when a command is denied by a policy.
+const (
+	denyCommand      = "command not allowed"
+	denyExpression   = "denied by expression"
+	denyNetblock     = "denied netblock"
+	denyNoPolicy     = "no policy for client"
+	denyRead         = "variable not readable"
+	denyUndocumented = "undocumented command"
+	denyWrite        = "variable not writable"
+)
+
+const (
+	defaultAuthTimeout    = 5 * time.Second
+	defaultFirstCommand   = 30 * time.Second
+	defaultInterlockCache = time.Second
+	defaultModeFileCache  = time.Second
+	defaultMaxIdle        = 5 * time.Minute
+	defaultMaxLineLength  = 256
+)
 
 type Config struct {
-	Bind    netip.Addr               `json:"bind"`
-	MaxIdle time.Duration            `json:"max_idle"`
-	Policy  map[netip.Prefix]*Policy `json:"policy"`
-	Targets map[string]*Target       `json:"targets"`
+	// Admin enables the administrative HTTP interface.
+	Admin *Admin `json:"admin"`
+	// AuthTimeout limits the time a client which has no route may take to
+	// authenticate with the XAUTH command. Such clients are only accepted
+	// when a principal has a token. It is capped by FirstCommandTimeout.
+	AuthTimeout time.Duration `json:"auth_timeout"`
+	// Ban enables the automatic banning of clients which repeatedly fail.
+	Ban  *Ban       `json:"ban"`
+	Bind netip.Addr `json:"bind"`
+	// Deny lists netblocks which may not connect to any target, unless a
+	// more specific policy applies.
+	Deny []netip.Prefix `json:"deny"`
+	// FirstCommandTimeout limits the time a client may take to send its
+	// first command after connecting.
+	FirstCommandTimeout time.Duration `json:"first_command_timeout"`
+	// IdentityPolicy contains policies for authenticated principals. The
+	// keys are principal names or a group name with a "group:" prefix.
+	IdentityPolicy map[string]*Policy `json:"identity_policy"`
+	// InterlockCache is the length of time for which machine state used by
+	// interlocks is cached.
+	InterlockCache time.Duration `json:"interlock_cache"`
+	// Journal is the path of a file to which writes selected by a policy's
+	// journal_writes are recorded.
+	Journal string        `json:"journal"`
+	MaxIdle time.Duration `json:"max_idle"`
+	// MaxLineLength limits the length of a single client message.
+	MaxLineLength int `json:"max_line_length"`
+	// MaxSessions limits the number of concurrent sessions for each target.
+	// It may be overridden on a per-target basis. Zero is unlimited.
+	MaxSessions int `json:"max_sessions"`
+	// MaxSessionsPerClient limits the number of concurrent sessions from a
+	// single source IP address, across all targets. Zero is unlimited.
+	MaxSessionsPerClient int `json:"max_sessions_per_client"`
+	// Mode restricts the use of all targets. It may be overridden at runtime
+	// by the mode file or through the admin interface.
+	Mode Mode `json:"mode"`
+	// ModeFile is the path of a sentinel file. If the file exists, it
+	// contains a mode which overrides the configured global mode.
+	ModeFile string `json:"mode_file"`
+	// ModeFileCache is the length of time for which the contents of mode
+	// files are cached. Defaults to one second.
+	ModeFileCache time.Duration            `json:"mode_file_cache"`
+	Policy        map[netip.Prefix]*Policy `json:"policy"`
+	// Principals defines named clients.
+	Principals map[string]*Principal `json:"principals"`
+	// Schedules defines named time windows which may be attached to
+	// policies.
+	Schedules map[string]*Schedule `json:"schedules"`
+	// ShadowPolicy contains candidate policies which are evaluated alongside
+	// the enforced policies. Differences are logged, but do not affect the
+	// proxy's behavior.
+	ShadowPolicy *ShadowPolicy `json:"shadow_policy"`
+	// Symbols names macro variables on all targets. Names may be used by
+	// clients in place of variable numbers, and are included in log
+	// messages.
+	Symbols map[string]*Symbol `json:"symbols"`
+	Targets map[string]*Target `json:"targets"`
+	// TLS enables TLS for all targets. It may be overridden on a per-target
+	// basis.
+	TLS *TLS `json:"tls"`
+	// WriteBudget limits the rate of writes to each target from all
+	// sessions. It may be overridden on a per-target basis.
+	WriteBudget *WriteBudget `json:"write_budget"`
+
+	byIdentity map[string]string // Certificate identity to principal name.
+}
+
+// ReadConfig decodes a JSON configuration. The configuration must be expanded
+// before it is used.
+func ReadConfig(r io.Reader) (*Config, error) {
+	cfg := &Config{}
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
 }
 
-func (c *Config) expandPolicy() {
+// Expand validates the configuration and computes derived data. An
+// error will be returned if the configuration cannot be used.
+func (c *Config) Expand() error {
+	switch {
+	case c.AuthTimeout < 0:
+		return errors.New("auth_timeout must not be negative")
+	case c.FirstCommandTimeout < 0:
+		return errors.New("first_command_timeout must not be negative")
+	case c.InterlockCache < 0:
+		return errors.New("interlock_cache must not be negative")
+	case c.MaxIdle < 0:
+		return errors.New("max_idle must not be negative")
+	case c.MaxLineLength < 0:
+		return errors.New("max_line_length must not be negative")
+	case c.MaxSessions < 0:
+		return errors.New("max_sessions must not be negative")
+	case c.MaxSessionsPerClient < 0:
+		return errors.New("max_sessions_per_client must not be negative")
+	case c.ModeFileCache < 0:
+		return errors.New("mode_file_cache must not be negative")
+	}
+	if c.AuthTimeout == 0 {
+		c.AuthTimeout = defaultAuthTimeout
+	}
+	if c.FirstCommandTimeout == 0 {
+		c.FirstCommandTimeout = defaultFirstCommand
+	}
+	if c.InterlockCache == 0 {
+		c.InterlockCache = defaultInterlockCache
+	}
 	if c.MaxIdle == 0 {
 		c.MaxIdle = defaultMaxIdle
 	}
+	if c.MaxLineLength == 0 {
+		c.MaxLineLength = defaultMaxLineLength
+	}
+	if c.Mode == "" {
+		c.Mode = ModeNormal
+	}
+	if c.ModeFileCache == 0 {
+		c.ModeFileCache = defaultModeFileCache
+	}
+	if err := c.Mode.validate(); err != nil {
+		return err
+	}
+	if err := c.expandPrincipals(); err != nil {
+		return err
+	}
+	if c.TLS != nil {
+		if err := c.TLS.load(); err != nil {
+			return err
+		}
+	}
+	if c.Admin != nil && c.Admin.TLS != nil {
+		if err := c.Admin.TLS.load(); err != nil {
+			return fmt.Errorf("admin: %w", err)
+		}
+	}
+	for name, schedule := range c.Schedules {
+		if err := schedule.expand(); err != nil {
+			return fmt.Errorf("schedule %s: %w", name, err)
+		}
+	}
+	if c.Ban != nil {
+		if err := c.Ban.validate(); err != nil {
+			return fmt.Errorf("ban: %w", err)
+		}
+	}
+	if c.WriteBudget != nil {
+		if err := c.WriteBudget.validate(); err != nil {
+			return fmt.Errorf("write_budget: %w", err)
+		}
+	}
+	if _, err := newSymbolTable(c.Symbols, nil); err != nil {
+		return err
+	}
+	if err := c.validatePolicies(c.Policy, c.IdentityPolicy); err != nil {
+		return err
+	}
+	if s := c.ShadowPolicy; s != nil {
+		if err := c.validatePolicies(s.Policy, s.IdentityPolicy); err != nil {
+			return fmt.Errorf("shadow_policy: %w", err)
+		}
+	}
 	for dest, tgt := range c.Targets {
-		ordered := make([]*orderedPolicy, 0, len(c.Policy)+len(tgt.Policy))
-
-		// Copy base policies into target map.
-		for k, v := range c.Policy {
-			if !k.IsValid() {
-				continue
+		if tgt.MaxSessions < 0 {
+			return fmt.Errorf("target %s: max_sessions must not be negative", dest)
+		} else if tgt.MaxSessions == 0 {
+			tgt.MaxSessions = c.MaxSessions
+		}
+		if err := tgt.Mode.validate(); err != nil {
+			return fmt.Errorf("target %s: %w", dest, err)
+		}
+		if tgt.Virtual != nil {
+			if err := tgt.Virtual.validate(); err != nil {
+				return fmt.Errorf("target %s: virtual: %w", dest, err)
 			}
-			ordered = append(ordered, &orderedPolicy{
-				Prefix: k,
-				Policy: v,
-			})
+		}
+		symbols, err := newSymbolTable(c.Symbols, tgt.Symbols)
+		if err != nil {
+			return fmt.Errorf("target %s: %w", dest, err)
+		}
+		tgt.symbols = symbols
+		if tgt.WriteBudget == nil {
+			tgt.WriteBudget = c.WriteBudget
+		} else if err := tgt.WriteBudget.validate(); err != nil {
+			return fmt.Errorf("target %s: write_budget: %w", dest, err)
+		}
+		if err := c.validatePolicies(tgt.Policy, tgt.IdentityPolicy); err != nil {
+			return fmt.Errorf("target %s: %w", dest, err)
 		}
 
-		// Per-target policies have higher priority.
-		for k, v := range tgt.Policy {
-			if !k.IsValid() {
-				continue
+		if tgt.TLS == nil {
+			tgt.tls = c.TLS
+		} else {
+			if err := tgt.TLS.load(); err != nil {
+				return fmt.Errorf("target %s: %w", dest, err)
 			}
-			ordered = append(ordered, &orderedPolicy{
-				Prefix:   k,
-				Priority: 1,
-				Policy:   v,
-			})
+			tgt.tls = tgt.TLS
 		}
 
-		if len(ordered) == 0 {
+		defaulted, err := c.resolve(tgt,
+			policyBlocks{c.Deny, c.IdentityPolicy, c.Policy},
+			policyBlocks{tgt.Deny, tgt.IdentityPolicy, tgt.Policy})
+		if err != nil {
+			return fmt.Errorf("target %s: %w", dest, err)
+		}
+		if defaulted {
 			slog.Warn("using default localhost policy", slog.Any("hostname", dest))
-			policy := &Policy{}
-			tgt.ordered = []*orderedPolicy{
-				{
-					Prefix: netip.PrefixFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), 32),
-					Policy: policy,
-				},
-				{
-					Prefix: netip.PrefixFrom(netip.IPv6Loopback(), 128),
-					Policy: policy,
-				},
+		}
+
+		// Shadow policies replace the enforced policies at the same level.
+		tgt.shadow = nil
+		if c.ShadowPolicy != nil || tgt.ShadowPolicy != nil {
+			global := policyBlocks{c.Deny, c.IdentityPolicy, c.Policy}
+			if c.ShadowPolicy != nil {
+				global = c.ShadowPolicy.blocks()
 			}
-		} else {
-			slices.SortFunc(ordered, func(a, b *orderedPolicy) int {
-				// Sort by priority.
-				if c := a.Priority - b.Priority; c != 0 {
-					return c
+			local := policyBlocks{tgt.Deny, tgt.IdentityPolicy, tgt.Policy}
+			if tgt.ShadowPolicy != nil {
+				if err := c.validatePolicies(tgt.ShadowPolicy.Policy, tgt.ShadowPolicy.IdentityPolicy); err != nil {
+					return fmt.Errorf("target %s: shadow_policy: %w", dest, err)
 				}
-				// Then by number of bits in the mask.
-				if c := a.Prefix.Bits() - b.Prefix.Bits(); c != 0 {
-					return c
-				}
-				// Then by starting IP address.
-				return bytes.Compare(a.Prefix.Addr().AsSlice(), b.Prefix.Addr().AsSlice())
-			})
+				local = tgt.ShadowPolicy.blocks()
+			}
+			tgt.shadow = &Target{}
+			if _, err := c.resolve(tgt.shadow, global, local); err != nil {
+				return fmt.Errorf("target %s: shadow_policy: %w", dest, err)
+			}
+		}
+	}
+	return nil
+}
+
+// A ShadowPolicy contains the policy blocks to be evaluated in shadow mode. A
+// shadow policy replaces all the enforced policy blocks at the same level of
+// the configuration. Enforced blocks are used at levels which do not define a
+// shadow policy.
+type ShadowPolicy struct {
+	Deny           []netip.Prefix           `json:"deny"`
+	IdentityPolicy map[string]*Policy       `json:"identity_policy"`
+	Policy         map[netip.Prefix]*Policy `json:"policy"`
+}
+
+func (s *ShadowPolicy) blocks() policyBlocks {
+	return policyBlocks{s.Deny, s.IdentityPolicy, s.Policy}
+}
+
+// policyBlocks are the policy definitions which may appear at the top level
+// of the configuration or within a target.
+type policyBlocks struct {
+	deny     []netip.Prefix
+	identity map[string]*Policy
+	netblock map[netip.Prefix]*Policy
+}
+
+// resolve populates the target's identity policies and ordered netblock
+// entries from the global and per-target policy blocks. If neither contains
+// any entries, a default policy for localhost is used.
+func (c *Config) resolve(tgt *Target, global, local policyBlocks) (defaulted bool, _ error) {
+	// Per-target identity policies replace global ones, unless they
+	// inherit from them.
+	tgt.identities = make(map[string]*Policy, len(global.identity)+len(local.identity))
+	maps.Copy(tgt.identities, global.identity)
+	for k, v := range local.identity {
+		if base, ok := global.identity[k]; ok && v.Inherit {
+			merged, err := c.mergePolicies(base, v)
+			if err != nil {
+				return false, fmt.Errorf("identity policy %s: %w", k, err)
+			}
+			v = merged
+		}
+		tgt.identities[k] = v
+	}
+
+	ordered := make([]*orderedPolicy, 0,
+		len(global.netblock)+len(local.netblock)+len(global.deny)+len(local.deny))
 
-			tgt.ordered = ordered
+	// Copy base policies into target map.
+	for k, v := range global.netblock {
+		if !k.IsValid() {
+			continue
 		}
+		ordered = append(ordered, &orderedPolicy{
+			Prefix: k,
+			Policy: v,
+		})
+	}
+	for _, k := range global.deny {
+		ordered = append(ordered, &orderedPolicy{
+			Deny:   true,
+			Prefix: k.Masked(),
+		})
+	}
+
+	// Per-target policies have higher priority. An inheriting policy is
+	// merged with the global policies which contain its netblock, from
+	// the least to the most specific.
+	for k, v := range local.netblock {
+		if !k.IsValid() {
+			continue
+		}
+		if v.Inherit {
+			merged, err := c.inheritNetblock(global.netblock, k, v)
+			if err != nil {
+				return false, fmt.Errorf("policy %s: %w", k, err)
+			}
+			v = merged
+		}
+		ordered = append(ordered, &orderedPolicy{
+			Prefix:   k,
+			Priority: 1,
+			Policy:   v,
+		})
+	}
+	for _, k := range local.deny {
+		ordered = append(ordered, &orderedPolicy{
+			Deny:     true,
+			Prefix:   k.Masked(),
+			Priority: 1,
+		})
+	}
+
+	if len(ordered) == 0 && len(tgt.identities) == 0 {
+		defaulted = true
+		policy := &Policy{}
+		tgt.ordered = []*orderedPolicy{
+			{
+				Prefix: netip.PrefixFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), 32),
+				Policy: policy,
+			},
+			{
+				Prefix: netip.PrefixFrom(netip.IPv6Loopback(), 128),
+				Policy: policy,
+			},
+		}
+	} else {
+		slices.SortFunc(ordered, func(a, b *orderedPolicy) int {
+			// The most specific netblock is checked first.
+			if c := b.Prefix.Bits() - a.Prefix.Bits(); c != 0 {
+				return c
+			}
+			// Then per-target entries.
+			if c := b.Priority - a.Priority; c != 0 {
+				return c
+			}
+			// Then deny entries.
+			if a.Deny != b.Deny {
+				if a.Deny {
+					return -1
+				}
+				return 1
+			}
+			// Then by starting IP address.
+			return bytes.Compare(a.Prefix.Addr().AsSlice(), b.Prefix.Addr().AsSlice())
+		})
 
+		tgt.ordered = ordered
+	}
+
+	// Apply global defaults.
+	for _, policy := range tgt.ordered {
+		if policy.Policy != nil && policy.MaxIdle == 0 {
+			policy.MaxIdle = c.MaxIdle
+		}
 	}
+	for _, policy := range tgt.identities {
+		if policy.MaxIdle == 0 {
+			policy.MaxIdle = c.MaxIdle
+		}
+	}
+	return defaulted, nil
 }
 
 type Policy struct {
+	// AllowCommands restricts the Q commands which may be sent. If set, only
+	// the listed commands are permitted, regardless of whether they are
+	// documented.
+	AllowCommands []QCommand `json:"allow_commands"`
+
+	// AllowExpr is an expression which permits commands that are not
+	// otherwise allowed by the policy. Writes remain subject to WriteRules
+	// and Interlocks.
+	AllowExpr string `json:"allow_expr"`
+
+	// AllowReads contains inclusive pairs of macro variable numbers that may
+	// be read. All variables may be read if empty.
+	AllowReads [][2]int `json:"allow_reads"`
+
 	// AllowUndocumentedQ allows Q commands that are not present in the Haas
 	// Mill User's Guide to be proxied.
 	AllowUndocumentedQ bool `json:"allow_undocumented_q"`
@@ -113,29 +457,275 @@ type Policy struct {
 	// be written to.
 	AllowWrites [][2]int `json:"allow_writes"`
 
+	// Approvals hold writes to ranges of macro variables until they are
+	// approved by a second principal. The first matching entry applies.
+	Approvals []*Approval `json:"approvals"`
+
 	// Audit triggers additional logging for each message.
 	Audit bool `json:"audit"`
+
+	// DenyCommands lists Q commands which may not be sent. It takes
+	// precedence over AllowCommands.
+	DenyCommands []QCommand `json:"deny_commands"`
+
+	// DenyExpr is an expression which denies matching commands. It takes
+	// precedence over all other rules.
+	DenyExpr string `json:"deny_expr"`
+
+	// DenyReads contains inclusive pairs of macro variable numbers that may
+	// not be read. It takes precedence over AllowReads.
+	DenyReads [][2]int `json:"deny_reads"`
+
+	// Inherit causes a per-target policy to be merged with the global
+	// policies for the same identity or for the netblocks which contain its
+	// own. List fields are combined, boolean fields are combined with a
+	// logical or, and any other fields which are set replace inherited
+	// values.
+	Inherit bool `json:"inherit"`
+
+	// Interlocks make writes conditional on the state of the machine.
+	Interlocks []*Interlock `json:"interlocks"`
+
+	// JournalWrites contains inclusive pairs of macro variable numbers. The
+	// current value of a variable in these ranges is read and recorded in
+	// the configuration's journal before a write is sent.
+	JournalWrites [][2]int `json:"journal_writes"`
+
+	// MaxIdle overrides the global idle timeout for matching clients.
+	MaxIdle time.Duration `json:"max_idle"`
+
+	// MaxSession limits the absolute lifetime of a client session. Zero is
+	// unlimited.
+	MaxSession time.Duration `json:"max_session"`
+
+	// RedactCommands lists Q commands whose response values are masked.
+	// Macro variable values are replaced with NaN.
+	RedactCommands []QCommand `json:"redact_commands"`
+
+	// RedactProgram blanks the program name in ?Q500 responses.
+	RedactProgram bool `json:"redact_program"`
+
+	// RedactReads contains inclusive pairs of macro variable numbers whose
+	// values are replaced with NaN.
+	RedactReads [][2]int `json:"redact_reads"`
+
+	// Remap maps the macro variable numbers used by a client onto those of
+	// the MDC host. Access checks apply to the MDC host's variables.
+	Remap []*Remap `json:"remap"`
+
+	// Schedule names an entry in the configuration's schedules. The policy
+	// is ignored outside of the schedule.
+	Schedule string `json:"schedule"`
+
+	// VerifyWrites reads back each variable after a successful write. The
+	// client receives an error if the stored value differs from the value
+	// which was sent.
+	VerifyWrites bool `json:"verify_writes"`
+
+	// WriteLimits restrict the rate at which a session may write to ranges
+	// of macro variables. Every limit which matches a variable applies.
+	WriteLimits []*WriteLimit `json:"write_limits"`
+
+	// WriteRules constrain the values written to macro variables. Every rule
+	// which matches a variable must be satisfied.
+	WriteRules []*WriteRule `json:"write_rules"`
+
+	allowExpr, denyExpr *expr.Program
+	schedule            *Schedule
 }
 
-// Allow returns true if the command is permitted by the policy.
-func (p *Policy) Allow(cmd message.Command) bool {
-	if cmd.IsSafe() {
-		return true
+// Active returns true if the policy applies at the given time.
+func (p *Policy) Active(now time.Time) bool {
+	return p.schedule == nil || p.schedule.Active(now)
+}
+
+// Allow returns true if the request is permitted by the policy. Otherwise, a
+// reason for the denial is returned. An expression which cannot be evaluated
+// denies the request.
+func (p *Policy) Allow(ctx context.Context, req *Request) (ok bool, reason string) {
+	var values expr.Values
+	if p.allowExpr != nil || p.denyExpr != nil {
+		values = req.values()
+	}
+	if p.denyExpr != nil {
+		if deny, err := p.denyExpr.Eval(values); err != nil || deny {
+			return false, denyExpression
+		}
 	}
+
+	cmd := req.Command
+	ok, reason = p.permit(cmd)
+	if !ok && p.allowExpr != nil {
+		if allow, err := p.allowExpr.Eval(values); err == nil && allow {
+			ok, reason = true, ""
+		}
+	}
+	if !ok || !cmd.IsWrite() {
+		return ok, reason
+	}
+
+	v, _ := cmd.Variable()
+	variable := int(v.Whole())
+	value, _ := cmd.Value()
+	for _, rule := range p.WriteRules {
+		if reason := rule.check(ctx, variable, value, req.Backend); reason != "" {
+			return false, reason
+		}
+	}
+	state := req.State
+	if state == nil {
+		state = req.Backend
+	}
+	for _, interlock := range p.Interlocks {
+		if reason := interlock.check(ctx, variable, state); reason != "" {
+			return false, reason
+		}
+	}
+	return true, ""
+}
+
+// permit applies the policy's variable ranges and command lists.
+func (p *Policy) permit(cmd message.Command) (ok bool, reason string) {
 	if cmd.IsWrite() {
 		v, _ := cmd.Variable()
-		return p.AllowWrite(int(v.Whole()))
+		if !p.AllowWrite(int(v.Whole())) {
+			return false, denyWrite
+		}
+		return true, ""
 	}
-	if _, ok := cmd.Command(); ok && p.AllowUndocumentedQ {
-		return true
+	n, isQ := cmd.Command()
+	if isQ && !p.AllowCommand(n) {
+		return false, denyCommand
 	}
-	return false
+	if v, ok := cmd.Variable(); ok && !p.AllowRead(int(v.Whole())) {
+		return false, denyRead
+	}
+	// An explicit allow list replaces the documented-command default.
+	if len(p.AllowCommands) > 0 || cmd.IsSafe() {
+		return true, ""
+	}
+	if isQ && p.AllowUndocumentedQ {
+		return true, ""
+	}
+	return false, denyUndocumented
+}
+
+// AllowCommand returns false if the Q command number is excluded by the
+// policy's command lists. Commands which pass this check are subject to the
+// policy's other rules.
+func (p *Policy) AllowCommand(n message.Number) bool {
+	matches := func(q QCommand) bool { return q.matches(n) }
+	if slices.ContainsFunc(p.DenyCommands, matches) {
+		return false
+	}
+	return len(p.AllowCommands) == 0 || slices.ContainsFunc(p.AllowCommands, matches)
+}
+
+// AllowRead returns true if reads of the given variable number are permitted
+// by the policy.
+func (p *Policy) AllowRead(v int) bool {
+	if inRanges(p.DenyReads, v) {
+		return false
+	}
+	return len(p.AllowReads) == 0 || inRanges(p.AllowReads, v)
 }
 
 // AllowWrite returns true if writes to the given variable number are permitted
 // by the policy.
 func (p *Policy) AllowWrite(v int) bool {
-	for _, pair := range p.AllowWrites {
+	return inRanges(p.AllowWrites, v)
+}
+
+// validatePolicies checks netblock and identity policies.
+func (c *Config) validatePolicies(
+	byPrefix map[netip.Prefix]*Policy, byIdentity map[string]*Policy,
+) error {
+	for prefix, policy := range byPrefix {
+		if err := c.validatePolicy(policy); err != nil {
+			return fmt.Errorf("policy %s: %w", prefix, err)
+		}
+	}
+	for name, policy := range byIdentity {
+		if err := c.validatePolicy(policy); err != nil {
+			return fmt.Errorf("identity policy %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// validatePolicy checks the policy against the rest of the configuration.
+func (c *Config) validatePolicy(p *Policy) error {
+	if len(p.JournalWrites) > 0 && c.Journal == "" {
+		return errors.New("journal_writes requires a journal file")
+	}
+	if len(p.Approvals) > 0 && (c.Admin == nil || len(c.Admin.Principals) == 0) {
+		return errors.New("approvals require admin principals")
+	}
+	return p.validate(c.Schedules)
+}
+
+// validate returns an error if the policy cannot be used. Expressions are
+// compiled and the schedule is resolved.
+func (p *Policy) validate(schedules map[string]*Schedule) error {
+	p.allowExpr, p.denyExpr, p.schedule = nil, nil, nil
+	if p.MaxIdle < 0 {
+		return errors.New("max_idle must not be negative")
+	}
+	if p.MaxSession < 0 {
+		return errors.New("max_session must not be negative")
+	}
+	if p.Schedule != "" {
+		schedule, ok := schedules[p.Schedule]
+		if !ok {
+			return fmt.Errorf("unknown schedule %q", p.Schedule)
+		}
+		p.schedule = schedule
+	}
+	if p.AllowExpr != "" {
+		prog, err := expr.Compile(p.AllowExpr, exprEnv)
+		if err != nil {
+			return fmt.Errorf("allow expression: %w", err)
+		}
+		p.allowExpr = prog
+	}
+	if p.DenyExpr != "" {
+		prog, err := expr.Compile(p.DenyExpr, exprEnv)
+		if err != nil {
+			return fmt.Errorf("deny expression: %w", err)
+		}
+		p.denyExpr = prog
+	}
+	for idx, rule := range p.WriteRules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("write rule %d: %w", idx, err)
+		}
+	}
+	for idx, interlock := range p.Interlocks {
+		if err := interlock.validate(); err != nil {
+			return fmt.Errorf("interlock %d: %w", idx, err)
+		}
+	}
+	for idx, approval := range p.Approvals {
+		if err := approval.validate(); err != nil {
+			return fmt.Errorf("approval %d: %w", idx, err)
+		}
+	}
+	for idx, remap := range p.Remap {
+		if err := remap.validate(); err != nil {
+			return fmt.Errorf("remap %d: %w", idx, err)
+		}
+	}
+	for idx, limit := range p.WriteLimits {
+		if err := limit.validate(); err != nil {
+			return fmt.Errorf("write limit %d: %w", idx, err)
+		}
+	}
+	return nil
+}
+
+// inRanges returns true if v falls within any of the inclusive pairs.
+func inRanges(ranges [][2]int, v int) bool {
+	for _, pair := range ranges {
 		if pair[0] <= v && v <= pair[1] {
 			return true
 		}
@@ -143,26 +733,166 @@ func (p *Policy) AllowWrite(v int) bool {
 	return false
 }
 
+// A QCommand identifies a Q command in a configuration file. It may be
+// written as a command number or as a name from the message catalog, such as
+// "three_in_one".
+type QCommand int
+
+// MarshalJSON implements [json.Marshaler]. Documented commands are written
+// using their catalog names.
+func (q QCommand) MarshalJSON() ([]byte, error) {
+	if name, ok := message.CommandName(message.Int(int(q))); ok {
+		return json.Marshal(name)
+	}
+	return json.Marshal(int(q))
+}
+
+// UnmarshalJSON implements [json.Unmarshaler].
+func (q *QCommand) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		var n int
+		if err := json.Unmarshal(data, &n); err != nil {
+			return errors.New("a Q command must be a number or a name")
+		}
+		name = strconv.Itoa(n)
+	}
+	n, ok := message.LookupCommand(name)
+	if !ok {
+		return fmt.Errorf("unknown Q command %q", name)
+	}
+	*q = QCommand(n.Whole())
+	return nil
+}
+
+// matches returns true if n is the command number.
+func (q QCommand) matches(n message.Number) bool {
+	return !n.IsNaN() && n.Frac() == 0 && n.Whole() == int64(q)
+}
+
 type Target struct {
+	// Deny lists netblocks which may not connect to the target, unless a
+	// more specific policy applies.
+	Deny []netip.Prefix `json:"deny"`
+	// IdentityPolicy overrides global identity policies for the target.
+	IdentityPolicy map[string]*Policy `json:"identity_policy"`
+	// MaxSessions overrides the global session limit for the target.
+	MaxSessions int `json:"max_sessions"`
+	// Mode restricts the use of the target. The more restrictive of the
+	// global and per-target modes applies.
+	Mode Mode `json:"mode"`
+	// ModeFile is the path of a sentinel file which overrides the target's
+	// configured mode.
+	ModeFile  string                   `json:"mode_file"`
 	Policy    map[netip.Prefix]*Policy `json:"policy"`
 	ProxyPort uint16                   `json:"proxy_port"`
+	// ShadowPolicy overrides the global shadow policies for the target.
+	ShadowPolicy *ShadowPolicy `json:"shadow_policy"`
+	// Symbols names macro variables on the target. They replace global
+	// symbols with the same name.
+	Symbols map[string]*Symbol `json:"symbols"`
+	// Tags are labels which may be used in policy expressions.
+	Tags []string `json:"tags"`
+	// TLS overrides the global TLS configuration for the target.
+	TLS *TLS `json:"tls"`
+	// Virtual configures macro variables which are hosted by the proxy.
+	Virtual *Virtual `json:"virtual"`
+	// WriteBudget overrides the global write budget for the target.
+	WriteBudget *WriteBudget `json:"write_budget"`
 
-	ordered []*orderedPolicy
+	identities map[string]*Policy
+	ordered    []*orderedPolicy
+	shadow     *Target // Resolved shadow policies, if any.
+	symbols    *SymbolTable
+	tls        *TLS
 }
 
-// PolicyFor returns the access policy for the given source address, if
-// configured.
-func (t *Target) PolicyFor(source netip.Addr) (*Policy, bool) {
-	for _, policy := range t.ordered {
-		if policy.Contains(source) {
-			return policy.Policy, true
+// PolicyFor returns the access policy for the given source address and
+// authenticated principal at the given time, if configured. A policy for the
+// principal takes precedence over policies for its groups, in the order in
+// which the groups are listed. Identity policies take precedence over netblock
+// policies. The most specific netblock entry applies, and per-target entries
+// take precedence over global ones for the same netblock. A matching deny
+// entry means that no policy applies. Policies which are outside of their
+// schedules are skipped.
+func (t *Target) PolicyFor(source netip.Addr, who *principal, now time.Time) (*Policy, bool) {
+	_, _, policy := t.match(source, who, now)
+	return policy, policy != nil
+}
+
+// match implements PolicyFor. It returns the name of a matching identity
+// policy, or the matching netblock entry, and the policy to apply. The policy
+// will be nil if a deny entry matches.
+func (t *Target) match(source netip.Addr, who *principal, now time.Time) (
+	identity string, netblock *orderedPolicy, policy *Policy,
+) {
+	if who != nil {
+		if policy, ok := t.identities[who.name]; ok && policy.Active(now) {
+			return who.name, nil, policy
+		}
+		for _, group := range who.groups {
+			if policy, ok := t.identities[groupPrefix+group]; ok && policy.Active(now) {
+				return groupPrefix + group, nil, policy
+			}
+		}
+	}
+	for _, entry := range t.ordered {
+		if !entry.Contains(source) {
+			continue
 		}
+		if entry.Deny {
+			return "", entry, nil
+		}
+		if entry.Active(now) {
+			return "", entry, entry.Policy
+		}
+	}
+	return "", nil, nil
+}
+
+// An EffectivePolicy is an entry used to choose the policy for a client of a
+// target, after inheritance has been applied.
+type EffectivePolicy struct {
+	// Deny is set for an explicit deny entry.
+	Deny bool `json:"deny,omitempty"`
+	// Identity is the principal or group name of an identity policy.
+	Identity string  `json:"identity,omitempty"`
+	Policy   *Policy `json:"policy,omitempty"`
+	// Prefix is the netblock of a netblock policy or deny entry.
+	Prefix netip.Prefix `json:"prefix,omitzero"`
+	// Target is set if the entry was defined by the target, rather than at
+	// the top level of the configuration.
+	Target bool `json:"target,omitempty"`
+}
+
+// EffectivePolicies returns the entries used to choose the policy for a
+// client of the target. Identity policies are sorted by name, followed by
+// netblock entries in the order in which they are checked. The configuration
+// must have been loaded.
+func (t *Target) EffectivePolicies() []*EffectivePolicy {
+	ret := make([]*EffectivePolicy, 0, len(t.identities)+len(t.ordered))
+	for _, name := range slices.Sorted(maps.Keys(t.identities)) {
+		_, own := t.IdentityPolicy[name]
+		ret = append(ret, &EffectivePolicy{
+			Identity: name,
+			Policy:   t.identities[name],
+			Target:   own,
+		})
+	}
+	for _, entry := range t.ordered {
+		ret = append(ret, &EffectivePolicy{
+			Deny:   entry.Deny,
+			Policy: entry.Policy,
+			Prefix: entry.Prefix,
+			Target: entry.Priority > 0,
+		})
 	}
-	return nil, false
+	return ret
 }
 
 type orderedPolicy struct {
-	*Policy
+	*Policy // Nil for a deny entry.
 	netip.Prefix
+	Deny     bool
 	Priority int
 }
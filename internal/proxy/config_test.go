@@ -24,10 +24,15 @@ package proxy
 
 import (
 	"encoding/json"
+	"fmt"
+	"net/netip"
 	"os"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"vawter.tech/mdcmux/pkg/message"
 )
 
 // Validate the sample configuration parses correctly.
@@ -43,3 +48,413 @@ func TestDemoConfig(t *testing.T) {
 	dec.DisallowUnknownFields()
 	r.NoError(dec.Decode(&cfg))
 }
+
+// A configuration with unusable certificates should be rejected.
+func TestInvalidTLS(t *testing.T) {
+	r := require.New(t)
+
+	cfg := &Config{
+		TLS: &TLS{
+			Cert: "does-not-exist.crt",
+			Key:  "does-not-exist.key",
+		},
+	}
+	r.ErrorContains(cfg.Expand(), "could not load tls certificate")
+
+	cfg = &Config{
+		Targets: map[string]*Target{
+			"example:5051": {TLS: &TLS{}},
+		},
+	}
+	r.ErrorContains(cfg.Expand(), "tls requires both a cert and a key")
+}
+
+func TestInvalidLimits(t *testing.T) {
+	tcs := []struct {
+		cfg *Config
+		err string
+	}{
+		{&Config{AuthTimeout: -1}, "auth_timeout must not be negative"},
+		{&Config{FirstCommandTimeout: -1}, "first_command_timeout must not be negative"},
+		{&Config{InterlockCache: -1}, "interlock_cache must not be negative"},
+		{&Config{MaxIdle: -1}, "max_idle must not be negative"},
+		{&Config{MaxLineLength: -1}, "max_line_length must not be negative"},
+		{&Config{MaxSessions: -1}, "max_sessions must not be negative"},
+		{&Config{MaxSessionsPerClient: -1}, "max_sessions_per_client must not be negative"},
+		{&Config{ModeFileCache: -1}, "mode_file_cache must not be negative"},
+		{
+			&Config{Targets: map[string]*Target{"example:5051": {MaxSessions: -1}}},
+			"target example:5051: max_sessions must not be negative",
+		},
+		{
+			&Config{Policy: map[netip.Prefix]*Policy{
+				netip.MustParsePrefix("10.0.0.0/8"): {MaxIdle: -1},
+			}},
+			"policy 10.0.0.0/8: max_idle must not be negative",
+		},
+		{
+			&Config{Policy: map[netip.Prefix]*Policy{
+				netip.MustParsePrefix("10.0.0.0/8"): {MaxSession: -1},
+			}},
+			"policy 10.0.0.0/8: max_session must not be negative",
+		},
+	}
+	for idx, tc := range tcs {
+		t.Run(strconv.Itoa(idx), func(t *testing.T) {
+			require.EqualError(t, tc.cfg.Expand(), tc.err)
+		})
+	}
+}
+
+func TestIdentityPolicy(t *testing.T) {
+	r := require.New(t)
+
+	alice := &Policy{AllowWrites: [][2]int{{1, 1}}}
+	eng := &Policy{AllowWrites: [][2]int{{2, 2}}}
+	netblock := &Policy{}
+	target := &Policy{AllowWrites: [][2]int{{3, 3}}}
+
+	cfg := &Config{
+		IdentityPolicy: map[string]*Policy{
+			"alice":             alice,
+			"group:engineering": eng,
+		},
+		Policy: map[netip.Prefix]*Policy{
+			netip.MustParsePrefix("10.0.0.0/8"): netblock,
+		},
+		Principals: map[string]*Principal{
+			"alice": {
+				Groups:     []string{"engineering"},
+				Identities: []string{"alice.cnc.llc"},
+			},
+			"bob": {
+				From:   []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")},
+				Groups: []string{"engineering"},
+			},
+			"carol": {},
+		},
+		Targets: map[string]*Target{
+			"minimill": {},
+			"umc750": {
+				IdentityPolicy: map[string]*Policy{
+					"group:engineering": target,
+				},
+			},
+		},
+	}
+	r.NoError(cfg.Expand())
+
+	inside := netip.MustParseAddr("10.1.2.3")
+	outside := netip.MustParseAddr("10.2.2.3")
+
+	tcs := []struct {
+		target   string
+		source   netip.Addr
+		identity string
+		expect   *Policy
+	}{
+		{"minimill", inside, "", netblock},
+		{"minimill", inside, "alice.cnc.llc", alice},
+		{"minimill", inside, "alice", netblock}, // Identity not claimed.
+		{"minimill", inside, "bob", eng},
+		{"minimill", outside, "bob", netblock}, // Principal not allowed from source.
+		{"minimill", inside, "carol", netblock},
+		{"umc750", inside, "alice.cnc.llc", alice},
+		{"umc750", inside, "bob", target},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.target+" "+tc.identity+" "+tc.source.String(), func(t *testing.T) {
+			r := require.New(t)
+			creds := &credentials{}
+			if tc.identity != "" {
+				creds.identities = []string{tc.identity}
+			}
+			who, _ := cfg.authenticate(creds, tc.source)
+			found, ok := cfg.Targets[tc.target].PolicyFor(tc.source, who, time.Now())
+			r.True(ok)
+			r.Same(tc.expect, found)
+		})
+	}
+
+	// An identity may only be claimed once.
+	cfg = &Config{
+		Principals: map[string]*Principal{
+			"alice": {Identities: []string{"shared"}},
+			"bob":   {Identities: []string{"shared"}},
+		},
+	}
+	r.ErrorContains(cfg.Expand(), "claimed by principals")
+}
+
+func TestPolicyAllow(t *testing.T) {
+	policy := &Policy{
+		AllowReads:  [][2]int{{1, 1000}},
+		AllowWrites: [][2]int{{1, 33}},
+		DenyReads:   [][2]int{{500, 599}},
+	}
+	open := &Policy{}
+	kiosk := &Policy{
+		AllowCommands: []QCommand{500, 999},
+	}
+	hidden := &Policy{
+		AllowUndocumentedQ: true,
+		DenyCommands:       []QCommand{100, 300},
+	}
+
+	tcs := []struct {
+		policy *Policy
+		cmd    message.Command
+		reason string
+	}{
+		{policy, message.CommandMachineModel, ""},
+		{policy, message.BasicCommand(message.Int64(999)), denyUndocumented},
+		{policy, message.QueryCommand(message.Int64(1)), ""},
+		{policy, message.QueryCommand(message.Int64(499)), ""},
+		{policy, message.QueryCommand(message.Int64(500)), denyRead},
+		{policy, message.QueryCommand(message.Int64(599)), denyRead},
+		{policy, message.QueryCommand(message.Int64(1001)), denyRead},
+		{policy, message.WriteCommand(message.Int64(2), message.Int64(1)), ""},
+		{policy, message.WriteCommand(message.Int64(34), message.Int64(1)), denyWrite},
+		// Reads are allowed by default for backward compatibility.
+		{open, message.QueryCommand(message.Int64(10000)), ""},
+		{open, message.WriteCommand(message.Int64(2), message.Int64(1)), denyWrite},
+		// Only listed commands are allowed, documented or not.
+		{kiosk, message.CommandThreeInOne, ""},
+		{kiosk, message.BasicCommand(message.Int64(999)), ""},
+		{kiosk, message.CommandMachineSN, denyCommand},
+		{kiosk, message.QueryCommand(message.Int64(1)), denyCommand},
+		// Denied commands take precedence over the defaults.
+		{hidden, message.CommandMachineSN, denyCommand},
+		{hidden, message.CommandPowerOnTime, denyCommand},
+		{hidden, message.CommandThreeInOne, ""},
+		{hidden, message.BasicCommand(message.Int64(999)), ""},
+	}
+
+	for idx, tc := range tcs {
+		t.Run(strconv.Itoa(idx), func(t *testing.T) {
+			r := require.New(t)
+			ok, reason := tc.policy.Allow(t.Context(), &Request{Command: tc.cmd})
+			r.Equal(tc.reason == "", ok)
+			r.Equal(tc.reason, reason)
+		})
+	}
+}
+
+func TestQCommandJSON(t *testing.T) {
+	r := require.New(t)
+
+	var policy Policy
+	r.NoError(json.Unmarshal([]byte(
+		`{"allow_commands": ["three_in_one", "Q104", 102, "999"]}`), &policy))
+	r.Equal([]QCommand{500, 104, 102, 999}, policy.AllowCommands)
+
+	buf, err := json.Marshal(policy.AllowCommands)
+	r.NoError(err)
+	r.JSONEq(`["three_in_one", "mode", "machine_model", 999]`, string(buf))
+
+	r.ErrorContains(json.Unmarshal([]byte(`{"deny_commands": ["serial"]}`), &policy),
+		`unknown Q command "serial"`)
+	r.ErrorContains(json.Unmarshal([]byte(`{"deny_commands": [true]}`), &policy),
+		"must be a number or a name")
+}
+
+func TestPolicyExpressions(t *testing.T) {
+	cfg := &Config{
+		Policy: map[netip.Prefix]*Policy{
+			netip.MustParsePrefix("127.0.0.1/32"): {
+				AllowExpr: "cmd.write && var in 10800..10999 && value >= 0 && hour >= 6",
+				DenyExpr:  "cmd.name == 'machine_sn' && !('engineering' in groups) || 'lockout' in tags",
+			},
+		},
+		Targets: map[string]*Target{
+			"example:5051": {},
+		},
+	}
+	require.NoError(t, cfg.Expand())
+	policy := cfg.Policy[netip.MustParsePrefix("127.0.0.1/32")]
+
+	morning := time.Date(2025, 1, 1, 7, 0, 0, 0, time.Local)
+	night := time.Date(2025, 1, 1, 3, 0, 0, 0, time.Local)
+	write := func(v int, value message.Number) message.Command {
+		return message.WriteCommand(message.Int(v), value)
+	}
+
+	tcs := []struct {
+		req    *Request
+		reason string
+	}{
+		{&Request{Command: write(10800, message.Int(1)), Time: morning}, ""},
+		{&Request{Command: write(10800, message.Int(-1)), Time: morning}, denyWrite},
+		{&Request{Command: write(10800, message.Int(1)), Time: night}, denyWrite},
+		{&Request{Command: write(11000, message.Int(1)), Time: morning}, denyWrite},
+		{&Request{Command: message.CommandMachineSN}, denyExpression},
+		{&Request{Command: message.CommandMachineSN, Groups: []string{"engineering"}}, ""},
+		{&Request{Command: message.CommandMode}, ""},
+		{&Request{Command: message.CommandMode, Tags: []string{"lockout"}}, denyExpression},
+	}
+
+	for idx, tc := range tcs {
+		t.Run(strconv.Itoa(idx), func(t *testing.T) {
+			r := require.New(t)
+			ok, reason := policy.Allow(t.Context(), tc.req)
+			r.Equal(tc.reason == "", ok)
+			r.Equal(tc.reason, reason)
+		})
+	}
+}
+
+// A bad expression should reject the configuration.
+func TestInvalidPolicyExpression(t *testing.T) {
+	r := require.New(t)
+
+	cfg := &Config{
+		Targets: map[string]*Target{
+			"example:5051": {
+				Policy: map[netip.Prefix]*Policy{
+					netip.MustParsePrefix("10.0.0.0/8"): {AllowExpr: "cmd.write && hours > 6"},
+				},
+			},
+		},
+	}
+	r.ErrorContains(cfg.Expand(),
+		`target example:5051: policy 10.0.0.0/8: allow expression: offset 13: unknown name "hours"`)
+}
+
+func TestDenyAndInherit(t *testing.T) {
+	r := require.New(t)
+
+	broad := &Policy{AllowWrites: [][2]int{{1, 10}}, Audit: true}
+	narrow := &Policy{AllowReads: [][2]int{{1, 100}}}
+	exception := &Policy{}
+	alice := &Policy{AllowWrites: [][2]int{{40, 40}}}
+
+	cfg := &Config{
+		Deny: []netip.Prefix{netip.MustParsePrefix("10.9.0.0/16")},
+		IdentityPolicy: map[string]*Policy{
+			"alice": alice,
+		},
+		Policy: map[netip.Prefix]*Policy{
+			netip.MustParsePrefix("10.0.0.0/8"):  broad,
+			netip.MustParsePrefix("10.1.0.0/16"): narrow,
+			netip.MustParsePrefix("10.9.1.0/24"): exception,
+		},
+		Principals: map[string]*Principal{"alice": {}},
+		Targets: map[string]*Target{
+			"umc750": {
+				Deny: []netip.Prefix{netip.MustParsePrefix("10.1.3.0/24")},
+				IdentityPolicy: map[string]*Policy{
+					"alice": {AllowWrites: [][2]int{{41, 41}}, Inherit: true},
+				},
+				Policy: map[netip.Prefix]*Policy{
+					netip.MustParsePrefix("10.1.2.0/24"): {
+						AllowWrites: [][2]int{{20, 30}},
+						Inherit:     true,
+						MaxIdle:     time.Minute,
+					},
+				},
+			},
+		},
+	}
+	r.NoError(cfg.Expand())
+	tgt := cfg.Targets["umc750"]
+
+	policyFor := func(addr string) *Policy {
+		found, ok := tgt.PolicyFor(netip.MustParseAddr(addr), nil, time.Now())
+		if !ok {
+			return nil
+		}
+		return found
+	}
+
+	r.Same(broad, policyFor("10.2.0.1"))
+	r.Same(narrow, policyFor("10.1.4.4")) // The most specific netblock wins.
+	r.Nil(policyFor("10.9.5.5"))          // Global deny.
+	r.Same(exception, policyFor("10.9.1.1"))
+	r.Nil(policyFor("10.1.3.3")) // Target deny.
+
+	merged := policyFor("10.1.2.3")
+	r.NotNil(merged)
+	r.Equal([][2]int{{1, 10}, {20, 30}}, merged.AllowWrites)
+	r.Equal([][2]int{{1, 100}}, merged.AllowReads)
+	r.True(merged.Audit)
+	r.Equal(time.Minute, merged.MaxIdle)
+
+	who, ok := cfg.principal("alice", netip.MustParseAddr("10.2.0.1"))
+	r.True(ok)
+	found, ok := tgt.PolicyFor(netip.MustParseAddr("10.2.0.1"), who, time.Now())
+	r.True(ok)
+	r.Equal([][2]int{{40, 40}, {41, 41}}, found.AllowWrites)
+
+	var summary []string
+	for _, entry := range tgt.EffectivePolicies() {
+		switch {
+		case entry.Identity != "":
+			summary = append(summary, fmt.Sprintf("%s %t", entry.Identity, entry.Target))
+		case entry.Deny:
+			summary = append(summary, fmt.Sprintf("deny %s %t", entry.Prefix, entry.Target))
+		default:
+			summary = append(summary, fmt.Sprintf("%s %t", entry.Prefix, entry.Target))
+		}
+	}
+	r.Equal([]string{
+		"alice true",
+		"deny 10.1.3.0/24 true",
+		"10.1.2.0/24 true",
+		"10.9.1.0/24 false",
+		"deny 10.9.0.0/16 false",
+		"10.1.0.0/16 false",
+		"10.0.0.0/8 false",
+	}, summary)
+}
+
+// Expressions are combined, rather than replaced, by an inheriting policy.
+func TestInheritPolicyExpressions(t *testing.T) {
+	r := require.New(t)
+
+	cfg := &Config{
+		Policy: map[netip.Prefix]*Policy{
+			netip.MustParsePrefix("10.0.0.0/8"): {
+				AllowExpr: "cmd.write && var in 100..199",
+				DenyExpr:  "cmd.name == 'machine_sn'",
+			},
+		},
+		Targets: map[string]*Target{
+			"umc750": {
+				Policy: map[netip.Prefix]*Policy{
+					netip.MustParsePrefix("10.1.0.0/16"): {
+						AllowExpr: "value >= 0",
+						DenyExpr:  "cmd.name == 'mode'",
+						Inherit:   true,
+					},
+				},
+			},
+		},
+	}
+	r.NoError(cfg.Expand())
+	policy, ok := cfg.Targets["umc750"].PolicyFor(netip.MustParseAddr("10.1.2.3"), nil, time.Now())
+	r.True(ok)
+	r.Equal("(cmd.write && var in 100..199) || (value >= 0)", policy.AllowExpr)
+	r.Equal("(cmd.name == 'machine_sn') || (cmd.name == 'mode')", policy.DenyExpr)
+
+	tcs := []struct {
+		cmd    message.Command
+		reason string
+	}{
+		{message.WriteCommand(message.Int(100), message.Int(1)), ""},
+		{message.WriteCommand(message.Int(100), message.Int(-1)), ""},
+		// The inheriting policy extends what the base policy allows.
+		{message.WriteCommand(message.Int(200), message.Int(1)), ""},
+		{message.WriteCommand(message.Int(200), message.Int(-1)), denyWrite},
+		{message.CommandMachineSN, denyExpression},
+		{message.CommandMode, denyExpression},
+		{message.CommandMachineModel, ""},
+	}
+	for idx, tc := range tcs {
+		t.Run(strconv.Itoa(idx), func(t *testing.T) {
+			r := require.New(t)
+			ok, reason := policy.Allow(t.Context(), &Request{Command: tc.cmd})
+			r.Equal(tc.reason == "", ok)
+			r.Equal(tc.reason, reason)
+		})
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"vawter.tech/mdcmux/pkg/message"
+)
+
+// An Explanation describes how a policy decision would be made for a client
+// of a target.
+type Explanation struct {
+	// Allowed is the decision for the command.
+	Allowed bool
+	// Command is the command after symbolic names have been resolved.
+	Command message.Command
+	// Entry is the effective policy entry which matched the client. It is
+	// nil if no entry matched.
+	Entry *EffectivePolicy
+	// Index is the position of Entry in the target's effective policies.
+	Index int
+	// Mode is the target's mode, as set by the configuration and any mode
+	// files. Overrides made through the admin interface are not known.
+	Mode Mode
+	// NeedsState is set if the decision depends on the state of the
+	// machine, which is not available when explaining a decision.
+	NeedsState bool
+	// Principal is the name of the authenticated principal, if any.
+	Principal string
+	// Reason is set when the command is denied.
+	Reason string
+	// Remapped is the command which would be sent to the MDC host, if the
+	// policy remaps its variable.
+	Remapped message.Command
+	// Symbol is the symbolic name of the command's variable, if any.
+	Symbol string
+	// Target is the hostname of the MDC host.
+	Target string
+	// WriteBudget is the target's write budget, if an allowed write would be
+	// counted against it.
+	WriteBudget *WriteBudget
+	// WriteLimits are the policy's rate limits which would apply to an
+	// allowed write. Whether a limit has been reached depends on the
+	// client's recent writes, which are not known.
+	WriteLimits []*WriteLimit
+}
+
+// Explain reports the policy which would be applied to a command line sent
+// by the client to the target at the given time. The line may use the
+// target's symbolic names. The target may be a hostname:port key or an
+// unambiguous hostname. If principal is non-empty, the client is treated as
+// having authenticated as that principal. The configuration must have been
+// loaded.
+func (c *Config) Explain(
+	ctx context.Context,
+	target string,
+	client netip.Addr,
+	principal string,
+	line string,
+	now time.Time,
+) (*Explanation, error) {
+	dest, err := c.findTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	who, err := c.explainPrincipal(principal, client)
+	if err != nil {
+		return nil, err
+	}
+	tgt := c.Targets[dest]
+
+	// Symbols are resolved before the command is parsed, as in the proxy.
+	raw := []byte(line)
+	symbolic := isSymbolic(raw)
+	if symbolic {
+		raw, err = tgt.symbols.resolve(raw)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cmd, err := message.ParseCommand(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid command %q: %w", line, err)
+	}
+	ret := &Explanation{
+		Command:   cmd,
+		Mode:      c.fileMode(ctx, tgt),
+		Principal: principal,
+		Target:    dest,
+	}
+
+	identity, netblock, policy := tgt.match(client, who, now)
+	entries := tgt.EffectivePolicies()
+	ret.Index = slices.IndexFunc(entries, func(e *EffectivePolicy) bool {
+		if identity != "" {
+			return e.Identity == identity
+		}
+		return netblock != nil && e.Identity == "" &&
+			e.Prefix == netblock.Prefix && e.Deny == netblock.Deny &&
+			e.Target == (netblock.Priority > 0)
+	})
+	if ret.Index >= 0 {
+		ret.Entry = entries[ret.Index]
+	}
+
+	switch {
+	case netblock != nil && netblock.Deny:
+		ret.Reason = denyNetblock
+	case policy == nil:
+		ret.Reason = denyNoPolicy
+	default:
+		if remapped, ok := policy.remap(cmd); ok && !symbolic {
+			cmd = remapped
+			ret.Remapped = remapped
+		}
+		var symbol *Symbol
+		if v, ok := cmd.Variable(); ok && v.Frac() == 0 {
+			ret.Symbol, symbol, _ = tgt.symbols.Name(int(v.Whole()))
+		}
+		switch {
+		case ret.Mode == ModeOffline:
+			ret.Reason = denyOffline
+			return ret, nil
+		case ret.Mode == ModeReadOnly && cmd.IsWrite():
+			ret.Reason = denyReadOnly
+			return ret, nil
+		}
+		if value, ok := cmd.Value(); ok && cmd.IsWrite() && symbol != nil && !symbol.accepts(value) {
+			ret.Reason = denySymbolType
+			return ret, nil
+		}
+		req := &Request{
+			Client:    client,
+			Command:   cmd,
+			Principal: principal,
+			Tags:      tgt.Tags,
+			Target:    dest,
+			Time:      now,
+		}
+		if who != nil {
+			req.Groups = who.groups
+		}
+		ret.Allowed, ret.Reason = policy.Allow(ctx, req)
+		ret.NeedsState = ret.Reason == denyNoCurrentValue || ret.Reason == denyNoMachineState
+		if ret.Allowed && cmd.IsWrite() {
+			v, _ := cmd.Variable()
+			variable := int(v.Whole())
+			for _, limit := range policy.WriteLimits {
+				if variable >= limit.Variables[0] && variable <= limit.Variables[1] {
+					ret.WriteLimits = append(ret.WriteLimits, limit)
+				}
+			}
+			ret.WriteBudget = tgt.WriteBudget
+		}
+	}
+	return ret, nil
+}
+
+// WriteAccess describes the macro variables which a client may write to a
+// target.
+type WriteAccess struct {
+	// Conditional is set if writes are subject to write rules, interlocks,
+	// approvals, or policy expressions.
+	Conditional bool
+	// Ranges are the writable variable ranges.
+	Ranges [][2]int
+	// Target is the hostname of the MDC host.
+	Target string
+}
+
+// WriteAccess reports the macro variables which the client may write to on
+// each target at the given time. Targets to which the client has no write
+// access are omitted. The configuration must have been loaded.
+func (c *Config) WriteAccess(client netip.Addr, principal string, now time.Time) ([]*WriteAccess, error) {
+	who, err := c.explainPrincipal(principal, client)
+	if err != nil {
+		return nil, err
+	}
+	var ret []*WriteAccess
+	for _, dest := range slices.Sorted(maps.Keys(c.Targets)) {
+		_, _, policy := c.Targets[dest].match(client, who, now)
+		if policy == nil || len(policy.AllowWrites) == 0 {
+			continue
+		}
+		ret = append(ret, &WriteAccess{
+			Conditional: len(policy.WriteRules) > 0 || len(policy.Interlocks) > 0 ||
+				len(policy.Approvals) > 0 || policy.AllowExpr != "" || policy.DenyExpr != "",
+			Ranges: policy.AllowWrites,
+			Target: dest,
+		})
+	}
+	return ret, nil
+}
+
+// explainPrincipal returns the named principal, if any, after checking that
+// it may authenticate from the client address.
+func (c *Config) explainPrincipal(name string, client netip.Addr) (*principal, error) {
+	if name == "" {
+		return nil, nil
+	}
+	if _, ok := c.Principals[name]; !ok {
+		return nil, fmt.Errorf("unknown principal %q", name)
+	}
+	who, ok := c.principal(name, client)
+	if !ok {
+		return nil, fmt.Errorf("principal %q may not authenticate from %s", name, client)
+	}
+	return who, nil
+}
+
+// findTarget returns the key of the target which matches the name.
+func (c *Config) findTarget(name string) (string, error) {
+	if _, ok := c.Targets[name]; ok {
+		return name, nil
+	}
+	var found []string
+	for dest := range c.Targets {
+		if host, _, err := net.SplitHostPort(dest); err == nil && host == name {
+			found = append(found, dest)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("unknown target %q", name)
+	case 1:
+		return found[0], nil
+	default:
+		slices.Sort(found)
+		return "", fmt.Errorf("target %q is ambiguous: %v", name, found)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"vawter.tech/mdcmux/pkg/message"
+)
+
+func TestExplain(t *testing.T) {
+	r := require.New(t)
+
+	cfg, err := ReadConfig(strings.NewReader(`{
+  "deny": ["10.9.0.0/16"],
+  "identity_policy": {
+    "group:engineering": {"allow_writes": [[40, 49]]}
+  },
+  "policy": {
+    "10.0.0.0/8": {
+      "allow_writes": [[10000, 10999]],
+      "write_rules": [{"variables": [10900, 10999], "max": 2}]
+    }
+  },
+  "principals": {
+    "alice": {"groups": ["engineering"], "from": ["10.1.0.0/16"]}
+  },
+  "targets": {
+    "umc750:5051": {
+      "policy": {
+        "10.1.2.0/24": {
+          "allow_writes": [[1, 10]],
+          "inherit": true,
+          "write_limits": [{"variables": [1, 5], "writes": 2, "interval": 1000000000}]
+        }
+      },
+      "symbols": {
+        "PALLET_READY": {"variable": 5, "type": "boolean"}
+      },
+      "write_budget": {"writes": 10, "interval": 60000000000}
+    },
+    "vf2:5051": {"mode": "read-only"},
+    "vf2:5052": {}
+  }
+}`))
+	r.NoError(err)
+	r.NoError(cfg.Expand())
+
+	ctx := context.Background()
+	now := time.Now()
+	explain := func(target, client, principal, line string) *Explanation {
+		ex, err := cfg.Explain(ctx, target, netip.MustParseAddr(client), principal, line, now)
+		r.NoError(err)
+		return ex
+	}
+
+	ex := explain("umc750", "10.1.2.3", "", "?E10900 1.5")
+	r.Equal("umc750:5051", ex.Target)
+	r.True(ex.Allowed)
+	r.Equal(1, ex.Index) // After the identity policy.
+	r.True(ex.Entry.Target)
+	r.Equal(netip.MustParsePrefix("10.1.2.0/24"), ex.Entry.Prefix)
+
+	ex = explain("umc750", "10.1.2.3", "", "?E10900 3")
+	r.False(ex.Allowed)
+	r.Equal(denyAboveMax, ex.Reason)
+
+	ex = explain("umc750:5051", "10.2.0.1", "", "?E5 1")
+	r.False(ex.Allowed)
+	r.Equal(denyWrite, ex.Reason)
+	r.False(ex.Entry.Target)
+	r.Equal(netip.MustParsePrefix("10.0.0.0/8"), ex.Entry.Prefix)
+
+	ex = explain("umc750", "10.9.0.1", "", "?Q102")
+	r.False(ex.Allowed)
+	r.Equal(denyNetblock, ex.Reason)
+	r.True(ex.Entry.Deny)
+
+	ex = explain("umc750", "192.168.0.1", "", "?Q102")
+	r.False(ex.Allowed)
+	r.Equal(denyNoPolicy, ex.Reason)
+	r.Nil(ex.Entry)
+	r.Equal(-1, ex.Index)
+
+	ex = explain("umc750", "10.1.2.3", "alice", "?E45 1")
+	r.True(ex.Allowed)
+	r.Equal("group:engineering", ex.Entry.Identity)
+	r.Equal(0, ex.Index)
+
+	// Symbols are resolved and checked, and rate limits are reported.
+	ex = explain("umc750", "10.1.2.3", "", "?E @PALLET_READY 1")
+	r.True(ex.Allowed, ex.Reason)
+	r.Equal(message.WriteCommand(message.Int(5), message.Int(1)), ex.Command)
+	r.Equal("PALLET_READY", ex.Symbol)
+	r.Len(ex.WriteLimits, 1)
+	r.Equal(10, ex.WriteBudget.Writes)
+
+	ex = explain("umc750", "10.1.2.3", "", "?E @PALLET_READY 2")
+	r.False(ex.Allowed)
+	r.Equal(denySymbolType, ex.Reason)
+
+	ex = explain("umc750", "10.1.2.3", "", "?E7 1")
+	r.True(ex.Allowed, ex.Reason)
+	r.Empty(ex.WriteLimits)
+
+	// Modes are applied before the policy.
+	ex = explain("vf2:5051", "10.2.0.1", "", "?E10000 1")
+	r.False(ex.Allowed)
+	r.Equal(ModeReadOnly, ex.Mode)
+	r.Equal(denyReadOnly, ex.Reason)
+
+	ex = explain("vf2:5051", "10.2.0.1", "", "?Q600 10000")
+	r.True(ex.Allowed, ex.Reason)
+
+	cfg.Mode = ModeOffline
+	ex = explain("umc750", "10.1.2.3", "", "?Q102")
+	r.False(ex.Allowed)
+	r.Equal(denyOffline, ex.Reason)
+	cfg.Mode = ""
+
+	// Checks which require the machine state are reported.
+	cfg.Policy[netip.MustParsePrefix("10.0.0.0/8")].WriteRules[0].MaxChange = 1
+	ex = explain("vf2:5052", "10.2.0.1", "", "?E10900 1")
+	r.False(ex.Allowed)
+	r.True(ex.NeedsState)
+
+	_, err = cfg.Explain(ctx, "vf2", netip.MustParseAddr("10.1.2.3"), "", "?Q600 100", now)
+	r.ErrorContains(err, "ambiguous")
+	_, err = cfg.Explain(ctx, "nope", netip.MustParseAddr("10.1.2.3"), "", "?Q600 100", now)
+	r.ErrorContains(err, "unknown target")
+	_, err = cfg.Explain(ctx, "umc750", netip.MustParseAddr("10.2.0.1"), "alice", "?Q600 100", now)
+	r.ErrorContains(err, "may not authenticate")
+	_, err = cfg.Explain(ctx, "umc750", netip.MustParseAddr("10.1.2.3"), "", "?E @NOPE 1", now)
+	r.ErrorContains(err, "unknown symbol")
+	_, err = cfg.Explain(ctx, "umc750", netip.MustParseAddr("10.1.2.3"), "", "?X", now)
+	r.ErrorContains(err, "invalid command")
+
+	access, err := cfg.WriteAccess(netip.MustParseAddr("10.1.2.3"), "", now)
+	r.NoError(err)
+	r.Len(access, 3)
+	r.Equal("umc750:5051", access[0].Target)
+	r.Equal([][2]int{{10000, 10999}, {1, 10}}, access[0].Ranges)
+	r.True(access[0].Conditional)
+
+	access, err = cfg.WriteAccess(netip.MustParseAddr("192.168.0.1"), "", now)
+	r.NoError(err)
+	r.Empty(access)
+}
+
+func TestReadConfigStrict(t *testing.T) {
+	r := require.New(t)
+
+	_, err := ReadConfig(strings.NewReader(`{"polcy": {}}`))
+	r.ErrorContains(err, "unknown field")
+}
@@ -0,0 +1,218 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"vawter.tech/mdcmux/pkg/message"
+)
+
+// Reasons for a journaled write to fail.
+const (
+	journalNoCurrentValue = "could not read current value"
+	journalUnavailable    = "journal unavailable"
+)
+
+// A JournalEntry records a write to a macro variable, along with the value
+// which was overwritten.
+type JournalEntry struct {
+	Client    netip.Addr `json:"client"`
+	New       string     `json:"new"`
+	Old       string     `json:"old"`
+	Principal string     `json:"principal,omitempty"`
+	Session   string     `json:"session"`
+	Target    string     `json:"target"`
+	Time      time.Time  `json:"time"`
+	Variable  int        `json:"variable"`
+}
+
+// ReadJournal decodes the entries in a journal file.
+func ReadJournal(r io.Reader) ([]*JournalEntry, error) {
+	var ret []*JournalEntry
+	in := bufio.NewScanner(r)
+	for line := 1; in.Scan(); line++ {
+		if len(in.Bytes()) == 0 {
+			continue
+		}
+		entry := &JournalEntry{}
+		if err := json.Unmarshal(in.Bytes(), entry); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		ret = append(ret, entry)
+	}
+	return ret, in.Err()
+}
+
+// Rollback returns the writes which would restore the variables changed by
+// the entries to the values they held before the earliest entry. Each
+// returned entry's Old value is the most recently written value, and its New
+// value is the value to be restored. The entries are sorted by target and
+// variable number.
+func Rollback(entries []*JournalEntry) []*JournalEntry {
+	type key struct {
+		target   string
+		variable int
+	}
+	sorted := slices.SortedStableFunc(slices.Values(entries), func(a, b *JournalEntry) int {
+		return a.Time.Compare(b.Time)
+	})
+	byKey := make(map[key]*JournalEntry)
+	var ret []*JournalEntry
+	for _, entry := range sorted {
+		k := key{entry.Target, entry.Variable}
+		if found, ok := byKey[k]; ok {
+			found.Old = entry.New
+			continue
+		}
+		undo := &JournalEntry{
+			New:      entry.Old,
+			Old:      entry.New,
+			Target:   entry.Target,
+			Variable: entry.Variable,
+		}
+		byKey[k] = undo
+		ret = append(ret, undo)
+	}
+	slices.SortFunc(ret, func(a, b *JournalEntry) int {
+		if c := cmp.Compare(a.Target, b.Target); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Variable, b.Variable)
+	})
+	return ret
+}
+
+// A journal is an append-only file of JournalEntry records.
+type journal struct {
+	path string
+
+	mu struct {
+		sync.Mutex
+		f *os.File
+	}
+}
+
+// openJournal opens the file for appending, creating it if necessary.
+func openJournal(path string) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j := &journal{path: path}
+	j.mu.f = f
+	return j, nil
+}
+
+// append durably records the entry.
+func (j *journal) append(entry *JournalEntry) error {
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.mu.f == nil {
+		return errors.New("journal closed")
+	}
+	if _, err := j.mu.f.Write(buf); err != nil {
+		return err
+	}
+	return j.mu.f.Sync()
+}
+
+func (j *journal) close() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.mu.f != nil {
+		_ = j.mu.f.Close()
+		j.mu.f = nil
+	}
+}
+
+// journalWrite reads the current value of the variable and records it before
+// the write is sent to the MDC host, if required by the policy. A reason is
+// returned if the write must not proceed.
+func (p *Proxy) journalWrite(
+	ctx context.Context, logger *slog.Logger, b *binding, session string, cmd message.Command,
+) string {
+	if !cmd.IsWrite() {
+		return ""
+	}
+	v, _ := cmd.Variable()
+	if !inRanges(b.policy.JournalWrites, int(v.Whole())) {
+		return ""
+	}
+	value, _ := cmd.Value()
+
+	p.mu.RLock()
+	j := p.mu.journal
+	p.mu.RUnlock()
+	if j == nil {
+		return journalUnavailable
+	}
+
+	// Don't use the machine state cache, which may be stale.
+	resp, err := b.backend.RoundTrip(ctx, message.QueryCommand(v))
+	if err != nil {
+		return journalNoCurrentValue
+	}
+	old, ok := resp.Value()
+	if !ok {
+		return journalNoCurrentValue
+	}
+
+	entry := &JournalEntry{
+		Client:   b.client,
+		New:      value.String(),
+		Old:      old.String(),
+		Session:  session,
+		Target:   b.mdc.Addr(),
+		Time:     time.Now().UTC(),
+		Variable: int(v.Whole()),
+	}
+	if b.who != nil {
+		entry.Principal = b.who.name
+	}
+	if err := j.append(entry); err != nil {
+		logger.ErrorContext(ctx, "could not write to journal",
+			slog.String("journal", j.path),
+			slog.Any("error", err))
+		return journalUnavailable
+	}
+	return ""
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"vawter.tech/mdcmux/internal/mdctest"
+	"vawter.tech/mdcmux/pkg/dummy"
+	"vawter.tech/mdcmux/pkg/message"
+	"vawter.tech/notify"
+)
+
+func TestJournal(t *testing.T) {
+	r := require.New(t)
+
+	ctx := mdctest.NewStopperForTest(t)
+
+	d, err := dummy.New(ctx, "127.0.0.1:0")
+	r.NoError(err)
+
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	cfg := notify.VarOf(&Config{
+		Bind:    netip.AddrFrom4([4]byte{127, 0, 0, 1}),
+		Journal: path,
+		Policy: map[netip.Prefix]*Policy{
+			netip.MustParsePrefix("127.0.0.1/32"): {
+				AllowWrites:   [][2]int{{1, 100}},
+				JournalWrites: [][2]int{{1, 10}},
+			},
+		},
+		Targets: map[string]*Target{
+			d.Addr().String(): {},
+		},
+	})
+	_, pConn := startProxy(t, ctx, cfg)
+
+	initial, err := pConn.RoundTrip(ctx, message.QueryCommand(message.Int(5)))
+	r.NoError(err)
+	initialValue, ok := initial.Value()
+	r.True(ok)
+
+	send := dialSession(t, pConn.Addr()).send
+	r.Equal("!", send("?E5 1.5"))
+	r.Equal("!", send("?E5 2.5"))
+	r.Equal("!", send("?E6 3.5"))
+	// Not journaled.
+	r.Equal("!", send("?E50 1"))
+
+	f, err := os.Open(path)
+	r.NoError(err)
+	defer func() { _ = f.Close() }()
+	entries, err := ReadJournal(f)
+	r.NoError(err)
+	r.Len(entries, 3)
+
+	r.Equal(5, entries[0].Variable)
+	r.Equal(initialValue.String(), entries[0].Old)
+	r.Equal("1.5", entries[0].New)
+	r.Equal("1.5", entries[1].Old)
+	r.Equal("2.5", entries[1].New)
+	r.Equal(d.Addr().String(), entries[0].Target)
+	r.Equal(netip.MustParseAddr("127.0.0.1"), entries[0].Client)
+	r.NotEmpty(entries[0].Session)
+	r.Equal(entries[0].Session, entries[2].Session)
+
+	undo := Rollback(entries)
+	r.Len(undo, 2)
+	r.Equal(5, undo[0].Variable)
+	r.Equal("2.5", undo[0].Old)
+	r.Equal(initialValue.String(), undo[0].New)
+	r.Equal(6, undo[1].Variable)
+	r.Equal("3.5", undo[1].Old)
+}
+
+func TestRollback(t *testing.T) {
+	r := require.New(t)
+
+	entries, err := ReadJournal(strings.NewReader(`
+{"target":"b:1","variable":1,"old":"0.0","new":"1.0","time":"2025-01-01T00:00:02Z"}
+{"target":"a:1","variable":2,"old":"5.0","new":"6.0","time":"2025-01-01T00:00:01Z"}
+{"target":"b:1","variable":1,"old":"9.0","new":"2.0","time":"2025-01-01T00:00:01Z"}
+`))
+	r.NoError(err)
+	r.Len(entries, 3)
+
+	undo := Rollback(entries)
+	r.Len(undo, 2)
+	r.Equal(&JournalEntry{Target: "a:1", Variable: 2, Old: "6.0", New: "5.0"}, undo[0])
+	// The earliest entry determines the restored value.
+	r.Equal(&JournalEntry{Target: "b:1", Variable: 1, Old: "1.0", New: "9.0"}, undo[1])
+
+	_, err = ReadJournal(strings.NewReader("{}\n{"))
+	r.ErrorContains(err, "line 2")
+}
+
+func TestJournalRequiresFile(t *testing.T) {
+	r := require.New(t)
+
+	cfg := &Config{
+		Policy: map[netip.Prefix]*Policy{
+			netip.MustParsePrefix("10.0.0.0/8"): {JournalWrites: [][2]int{{1, 10}}},
+		},
+	}
+	r.ErrorContains(cfg.Expand(), "journal_writes requires a journal file")
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"net/netip"
+	"slices"
+)
+
+// inheritNetblock merges a per-target netblock policy with the global
+// policies whose netblocks contain its own. Less specific global policies are
+// merged first.
+func (c *Config) inheritNetblock(
+	global map[netip.Prefix]*Policy, prefix netip.Prefix, policy *Policy,
+) (*Policy, error) {
+	var bases []*orderedPolicy
+	for k, v := range global {
+		if k.IsValid() && k.Bits() <= prefix.Bits() && k.Contains(prefix.Addr()) {
+			bases = append(bases, &orderedPolicy{Prefix: k, Policy: v})
+		}
+	}
+	slices.SortFunc(bases, func(a, b *orderedPolicy) int {
+		return a.Prefix.Bits() - b.Prefix.Bits()
+	})
+
+	policies := make([]*Policy, 0, len(bases)+1)
+	for _, base := range bases {
+		policies = append(policies, base.Policy)
+	}
+	return c.mergePolicies(append(policies, policy)...)
+}
+
+// mergePolicies returns a new policy which combines the given policies, in
+// order. Deny expressions are combined so that a command matching any of them
+// is denied, while allow expressions must all match. The result is validated
+// against the configuration.
+func (c *Config) mergePolicies(policies ...*Policy) (*Policy, error) {
+	ret := &Policy{}
+	for _, p := range policies {
+		ret.AllowCommands = append(ret.AllowCommands, p.AllowCommands...)
+		ret.AllowReads = append(ret.AllowReads, p.AllowReads...)
+		ret.AllowUndocumentedQ = ret.AllowUndocumentedQ || p.AllowUndocumentedQ
+		ret.AllowWrites = append(ret.AllowWrites, p.AllowWrites...)
+		ret.Approvals = append(ret.Approvals, p.Approvals...)
+		ret.Audit = ret.Audit || p.Audit
+		ret.DenyCommands = append(ret.DenyCommands, p.DenyCommands...)
+		ret.DenyReads = append(ret.DenyReads, p.DenyReads...)
+		ret.Interlocks = append(ret.Interlocks, p.Interlocks...)
+		ret.JournalWrites = append(ret.JournalWrites, p.JournalWrites...)
+		ret.RedactCommands = append(ret.RedactCommands, p.RedactCommands...)
+		ret.RedactProgram = ret.RedactProgram || p.RedactProgram
+		ret.RedactReads = append(ret.RedactReads, p.RedactReads...)
+		ret.Remap = append(ret.Remap, p.Remap...)
+		ret.VerifyWrites = ret.VerifyWrites || p.VerifyWrites
+		ret.WriteLimits = append(ret.WriteLimits, p.WriteLimits...)
+		ret.WriteRules = append(ret.WriteRules, p.WriteRules...)
+
+		ret.AllowExpr = combineExpr(ret.AllowExpr, p.AllowExpr, "||")
+		ret.DenyExpr = combineExpr(ret.DenyExpr, p.DenyExpr, "||")
+		if p.MaxIdle != 0 {
+			ret.MaxIdle = p.MaxIdle
+		}
+		if p.MaxSession != 0 {
+			ret.MaxSession = p.MaxSession
+		}
+		if p.Schedule != "" {
+			ret.Schedule = p.Schedule
+		}
+	}
+	if err := ret.validate(c.Schedules); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// combineExpr joins two expressions with a boolean operator. Either may be
+// empty.
+func combineExpr(a, b, op string) string {
+	switch {
+	case a == "":
+		return b
+	case b == "":
+		return a
+	default:
+		return "(" + a + ") " + op + " (" + b + ")"
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// offlineBanner is sent to clients of an offline target.
+const offlineBanner = "?, MDCMUX OFFLINE FOR MAINTENANCE"
+
+// Reasons reported when a command is denied by a mode.
+const (
+	denyOffline  = "offline mode"
+	denyReadOnly = "read-only mode"
+)
+
+// A Mode restricts the use of a target, regardless of policy.
+type Mode string
+
+// The available modes, from least to most restrictive.
+const (
+	// ModeNormal applies the configured policies.
+	ModeNormal Mode = "normal"
+	// ModeReadOnly denies all writes.
+	ModeReadOnly Mode = "read-only"
+	// ModeOffline refuses all connections with a maintenance message.
+	ModeOffline Mode = "offline"
+)
+
+// level orders modes by how restrictive they are.
+func (m Mode) level() int {
+	switch m {
+	case ModeReadOnly:
+		return 1
+	case ModeOffline:
+		return 2
+	default:
+		return 0
+	}
+}
+
+func (m Mode) validate() error {
+	switch m {
+	case "", ModeNormal, ModeReadOnly, ModeOffline:
+		return nil
+	default:
+		return fmt.Errorf("unknown mode %q", m)
+	}
+}
+
+// stricter returns the more restrictive of the two modes.
+func stricter(a, b Mode) Mode {
+	if b.level() > a.level() {
+		return b
+	}
+	return a
+}
+
+// readModeFile returns the mode named in a sentinel file, or an empty string
+// if the file does not exist. An empty or unreadable file selects read-only
+// mode, so that a mistake does not re-enable writes.
+func readModeFile(ctx context.Context, path string) Mode {
+	if path == "" {
+		return ""
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ""
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "could not read mode file",
+			slog.String("mode_file", path),
+			slog.Any("error", err))
+		return ModeReadOnly
+	}
+	mode := Mode(bytes.TrimSpace(data))
+	if mode == "" {
+		return ModeReadOnly
+	}
+	if err := mode.validate(); err != nil {
+		slog.WarnContext(ctx, "invalid mode file",
+			slog.String("mode_file", path),
+			slog.Any("error", err))
+		return ModeReadOnly
+	}
+	return mode
+}
+
+// modeFiles caches the contents of mode files, so that they are not read for
+// every message. The zero value is ready for use.
+type modeFiles struct {
+	mu     sync.Mutex
+	byPath map[string]modeFile
+}
+
+// A modeFile is a cached mode file.
+type modeFile struct {
+	mode Mode
+	read time.Time
+}
+
+// read returns the mode named in a sentinel file, reading the file again if
+// the cached contents are older than the ttl.
+func (f *modeFiles) read(ctx context.Context, path string, ttl time.Duration) Mode {
+	if path == "" {
+		return ""
+	}
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if cached, ok := f.byPath[path]; ok && now.Sub(cached.read) < ttl {
+		return cached.mode
+	}
+	if f.byPath == nil {
+		f.byPath = make(map[string]modeFile)
+	}
+	mode := readModeFile(ctx, path)
+	f.byPath[path] = modeFile{mode: mode, read: now}
+	return mode
+}
+
+// modeOverrides contains modes which have been set through the admin
+// interface. They take precedence over sentinel files and the configuration.
+// The zero value is ready for use.
+type modeOverrides struct {
+	mu         sync.Mutex
+	global     Mode
+	byHostname map[string]Mode
+}
+
+// get returns the override for a target, or the global override if the
+// hostname is empty.
+func (o *modeOverrides) get(hostname string) Mode {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if hostname == "" {
+		return o.global
+	}
+	return o.byHostname[hostname]
+}
+
+// set records an override for a target, or a global override if the hostname
+// is empty. An empty mode clears the override.
+func (o *modeOverrides) set(hostname string, mode Mode) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if hostname == "" {
+		o.global = mode
+		return
+	}
+	if mode == "" {
+		delete(o.byHostname, hostname)
+		return
+	}
+	if o.byHostname == nil {
+		o.byHostname = make(map[string]Mode)
+	}
+	o.byHostname[hostname] = mode
+}
+
+// globalMode returns the effective global mode.
+func (p *Proxy) globalMode(ctx context.Context, cfg *Config) Mode {
+	if mode := p.modes.get(""); mode != "" {
+		return mode
+	}
+	if mode := p.modeFiles.read(ctx, cfg.ModeFile, cfg.ModeFileCache); mode != "" {
+		return mode
+	}
+	return cfg.Mode
+}
+
+// modeFor returns the effective mode of a target, which is the more
+// restrictive of the global mode and the target's own mode.
+func (p *Proxy) modeFor(ctx context.Context, hostname string, target *Target) Mode {
+	cfg := p.config()
+	mode := p.modes.get(hostname)
+	if mode == "" {
+		mode = p.modeFiles.read(ctx, target.ModeFile, cfg.ModeFileCache)
+	}
+	if mode == "" {
+		mode = target.Mode
+	}
+	return stricter(stricter(ModeNormal, mode), p.globalMode(ctx, cfg))
+}
+
+// fileMode returns the mode of a target as set by the configuration and
+// sentinel files, ignoring any overrides from the admin interface.
+func (c *Config) fileMode(ctx context.Context, target *Target) Mode {
+	local := readModeFile(ctx, target.ModeFile)
+	if local == "" {
+		local = target.Mode
+	}
+	global := readModeFile(ctx, c.ModeFile)
+	if global == "" {
+		global = c.Mode
+	}
+	return stricter(stricter(ModeNormal, local), global)
+}
+
+// modeStatus describes the effective modes in the admin interface.
+type modeStatus struct {
+	Global  Mode            `json:"global"`
+	Targets map[string]Mode `json:"targets"`
+}
+
+// modeStatus returns the effective mode of each configured target.
+func (p *Proxy) modeStatus(ctx context.Context) *modeStatus {
+	cfg := p.config()
+	ret := &modeStatus{
+		Global:  stricter(ModeNormal, p.globalMode(ctx, cfg)),
+		Targets: make(map[string]Mode, len(cfg.Targets)),
+	}
+	for hostname, target := range cfg.Targets {
+		ret.Targets[hostname] = p.modeFor(ctx, hostname, target)
+	}
+	return ret
+}
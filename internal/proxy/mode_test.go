@@ -0,0 +1,142 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"vawter.tech/mdcmux/internal/mdctest"
+	"vawter.tech/mdcmux/pkg/dummy"
+	"vawter.tech/notify"
+)
+
+func TestMode(t *testing.T) {
+	r := require.New(t)
+
+	ctx := mdctest.NewStopperForTest(t)
+
+	d, err := dummy.New(ctx, "127.0.0.1:0")
+	r.NoError(err)
+
+	modeFile := filepath.Join(t.TempDir(), "maintenance")
+	adminCfg, roots := testAdmin(t, "alice")
+	cfg := notify.VarOf(&Config{
+		Admin:         adminCfg,
+		Bind:          netip.AddrFrom4([4]byte{127, 0, 0, 1}),
+		ModeFileCache: time.Nanosecond,
+		Policy: map[netip.Prefix]*Policy{
+			netip.MustParsePrefix("127.0.0.1/32"): {
+				AllowWrites: [][2]int{{1, 100}},
+			},
+		},
+		Principals: map[string]*Principal{
+			"alice": {Tokens: []string{HashToken("alice")}},
+			"bob":   {Tokens: []string{HashToken("bob")}},
+		},
+		Targets: map[string]*Target{
+			d.Addr().String(): {ModeFile: modeFile},
+		},
+	})
+	p, pConn := startProxy(t, ctx, cfg)
+
+	client := adminClient(t, p, roots)
+	admin := func(method, path string) int {
+		code, _ := client(method, path, "alice")
+		return code
+	}
+
+	send := dialSession(t, pConn.Addr()).send
+	r.Equal("!", send("?E5 1"))
+
+	// Only listed principals may change the mode.
+	code, _ := client("PUT", "/mode/read-only", "bob")
+	r.Equal(http.StatusForbidden, code)
+	code, _ = client("DELETE", "/mode", "bob")
+	r.Equal(http.StatusForbidden, code)
+	code, _ = client("GET", "/mode", "bob")
+	r.Equal(http.StatusOK, code)
+	r.Equal("!", send("?E5 1"))
+
+	r.Equal(http.StatusOK, admin("PUT", "/mode/read-only"))
+	r.Equal("?, MDCMUX READ ONLY", send("?E5 2"))
+	r.Equal("MACRO, 1.0", send("?Q600 5"))
+	r.Equal(http.StatusBadRequest, admin("PUT", "/mode/bogus"))
+	r.Equal(http.StatusNotFound, admin("PUT", "/mode/normal?target=nowhere:1"))
+
+	r.Equal(http.StatusOK, admin("DELETE", "/mode"))
+	r.Equal("!", send("?E5 3"))
+
+	// A target's sentinel file applies to existing and new sessions.
+	r.NoError(os.WriteFile(modeFile, []byte("offline\n"), 0644))
+	r.Equal(offlineBanner, send("?Q600 5"))
+	sess := dialSession(t, pConn.Addr())
+	banner, ok := sess.reply()
+	r.True(ok)
+	r.Equal(offlineBanner, banner)
+	_, ok = sess.reply()
+	r.False(ok)
+
+	// A global override cannot relax a target's mode.
+	r.Equal(http.StatusOK, admin("PUT", "/mode/normal"))
+	status := p.modeStatus(ctx)
+	r.Equal(ModeNormal, status.Global)
+	r.Equal(ModeOffline, status.Targets[d.Addr().String()])
+
+	// An empty file selects read-only mode.
+	r.NoError(os.WriteFile(modeFile, nil, 0644))
+	send = dialSession(t, pConn.Addr()).send
+	r.Equal("?, MDCMUX READ ONLY", send("?E5 4"))
+
+	r.NoError(os.Remove(modeFile))
+	r.Equal("!", send("?E5 4"))
+}
+
+func TestModeFileCache(t *testing.T) {
+	r := require.New(t)
+
+	ctx := t.Context()
+	path := filepath.Join(t.TempDir(), "maintenance")
+	var files modeFiles
+
+	r.Equal(Mode(""), files.read(ctx, path, time.Hour))
+	r.NoError(os.WriteFile(path, []byte("offline"), 0644))
+	r.Equal(Mode(""), files.read(ctx, path, time.Hour))
+	r.Equal(ModeOffline, files.read(ctx, path, 0))
+	r.Equal(Mode(""), files.read(ctx, "", 0))
+}
+
+func TestInvalidMode(t *testing.T) {
+	r := require.New(t)
+
+	cfg := &Config{Mode: "closed"}
+	r.ErrorContains(cfg.Expand(), `unknown mode "closed"`)
+
+	cfg = &Config{Targets: map[string]*Target{"127.0.0.1:5051": {Mode: "closed"}}}
+	r.ErrorContains(cfg.Expand(), `unknown mode "closed"`)
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+const (
+	// groupPrefix distinguishes group names from principal names in an
+	// identity_policy block.
+	groupPrefix = "group:"
+	// tokenPrefix identifies the hash algorithm used for a token.
+	tokenPrefix = "sha256:"
+)
+
+// A Principal is a named client which may be authenticated by a TLS client
+// certificate or by the in-band XAUTH command.
+type Principal struct {
+	// From restricts the source addresses from which the principal may be
+	// authenticated. Any source address is permitted if empty.
+	From []netip.Prefix `json:"from"`
+	// Groups lists the groups to which the principal belongs.
+	Groups []string `json:"groups"`
+	// Identities are TLS certificate subject common names or subject
+	// alternate names which authenticate as the principal. If empty, the
+	// principal's name is used.
+	Identities []string `json:"identities"`
+	// Tokens contains hashed secrets which may be presented with the XAUTH
+	// command. Each token has the form "sha256:<hex digest>".
+	Tokens []string `json:"tokens"`
+
+	digests [][sha256.Size]byte
+}
+
+// HashToken returns the form of the token to be stored in a configuration
+// file.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return tokenPrefix + hex.EncodeToString(sum[:])
+}
+
+// verify returns true if the digest matches one of the principal's tokens.
+func (p *Principal) verify(digest [sha256.Size]byte) bool {
+	ok := false
+	for _, d := range p.digests {
+		// Don't short-circuit to avoid leaking timing data.
+		if subtle.ConstantTimeCompare(d[:], digest[:]) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// credentials are presented by a client to authenticate as a principal.
+type credentials struct {
+	// Identities from a TLS client certificate.
+	identities []string
+	// A principal name and token digest from the XAUTH command.
+	name   string
+	digest [sha256.Size]byte
+}
+
+// A principal is an authenticated client.
+type principal struct {
+	name   string
+	groups []string
+}
+
+// listed returns true if the principal, or one of its groups with a "group:"
+// prefix, appears in the list of names.
+func (p *principal) listed(names []string) bool {
+	for _, name := range names {
+		if group, ok := strings.CutPrefix(name, groupPrefix); ok {
+			if slices.Contains(p.groups, group) {
+				return true
+			}
+		} else if name == p.name {
+			return true
+		}
+	}
+	return false
+}
+
+// LogValue implements [slog.LogValuer].
+func (p *principal) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("name", p.name),
+		slog.Any("groups", p.groups),
+	)
+}
+
+// expandPrincipals validates the principals and indexes their identities.
+func (c *Config) expandPrincipals() error {
+	c.byIdentity = make(map[string]string)
+	for name, p := range c.Principals {
+		if name == "" || strings.HasPrefix(name, groupPrefix) {
+			return fmt.Errorf("invalid principal name %q", name)
+		}
+		p.digests = make([][sha256.Size]byte, len(p.Tokens))
+		for idx, token := range p.Tokens {
+			hexDigest, ok := strings.CutPrefix(token, tokenPrefix)
+			if !ok {
+				return fmt.Errorf("principal %q: tokens must have a %q prefix", name, tokenPrefix)
+			}
+			if n, err := hex.Decode(p.digests[idx][:], []byte(hexDigest)); err != nil || n != sha256.Size {
+				return fmt.Errorf("principal %q: invalid token digest", name)
+			}
+		}
+
+		ids := p.Identities
+		if len(ids) == 0 {
+			ids = []string{name}
+		}
+		for _, id := range ids {
+			if other, dup := c.byIdentity[id]; dup {
+				return fmt.Errorf("identity %q claimed by principals %q and %q", id, other, name)
+			}
+			c.byIdentity[id] = name
+		}
+	}
+	return nil
+}
+
+// principal returns the named principal if it may be authenticated from the
+// source address.
+func (c *Config) principal(name string, source netip.Addr) (*principal, bool) {
+	p, ok := c.Principals[name]
+	if !ok {
+		return nil, false
+	}
+	if len(p.From) > 0 {
+		ok = false
+		for _, prefix := range p.From {
+			if prefix.Contains(source) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return nil, false
+		}
+	}
+	return &principal{name: name, groups: p.Groups}, true
+}
+
+// acceptsTokens returns true if any principal may authenticate with the
+// XAUTH command. If so, connections are accepted from every source address,
+// and those without a route are subject to the AuthTimeout.
+func (c *Config) acceptsTokens() bool {
+	for _, p := range c.Principals {
+		if len(p.digests) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate maps the client's credentials onto a principal. A principal
+// named by the XAUTH command takes precedence over certificate identities.
+// The token is re-verified so that configuration changes may revoke it. The
+// first certificate identity which is claimed by a principal is used.
+func (c *Config) authenticate(creds *credentials, source netip.Addr) (*principal, bool) {
+	if creds == nil {
+		return nil, false
+	}
+	if creds.name != "" {
+		if p, ok := c.Principals[creds.name]; ok && p.verify(creds.digest) {
+			return c.principal(creds.name, source)
+		}
+		return nil, false
+	}
+	for _, id := range creds.identities {
+		if name, ok := c.byIdentity[id]; ok {
+			return c.principal(name, source)
+		}
+	}
+	return nil, false
+}
@@ -24,11 +24,14 @@ package proxy
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
-	"io"
+	"fmt"
 	"log/slog"
 	"net"
 	"net/netip"
+	"strings"
 	"sync"
 	"time"
 
@@ -46,55 +49,287 @@ type Proxy struct {
 	mu struct {
 		sync.RWMutex
 
+		// The most recently applied configuration.
+		active *Config
+
 		// Network connections to the MDC servers are conserved across
 		// reconfiguration.
 		connByHostname map[string]*conn.Conn
 
+		// Cached machine state is associated with each connection.
+		stateByHostname map[string]*machineState
+
+		// The admin interface is conserved if its address is unchanged.
+		admin *adminServer
+
+		// The write journal is conserved if its path is unchanged.
+		journal *journal
+
 		// Network listeners are conserved.
 		listeners map[netip.AddrPort]*net.TCPListener
 
+		// Virtual variables are conserved if their file is unchanged.
+		virtualByHostname map[string]*virtualStore
+
 		routes map[*net.TCPListener]*listenerRoute
 	}
+
+	// Writes waiting for approval.
+	approvals approvalQueue
+
+	// Clients which have been banned for repeated failures.
+	bans banList
+
+	// Cached mode files.
+	modeFiles modeFiles
+
+	// Modes set through the admin interface.
+	modes modeOverrides
+
+	// Recent writes to each target, used to enforce write budgets.
+	budgets struct {
+		sync.Mutex
+		byHostname map[string]*rateWindow
+	}
+
+	// Concurrent session counts, used to enforce limits.
+	sessions struct {
+		sync.Mutex
+		byClient map[netip.Addr]int
+		byRoute  map[*listenerRoute]int
+	}
 }
 
 type listenerRoute struct {
 	mu struct {
 		sync.RWMutex
 
-		mdc      *conn.Conn
-		policies []*orderedPolicy
+		cfg     *Config
+		mdc     *conn.Conn
+		target  *Target
+		virtual *virtualStore // Nil if the target has no virtual variables.
+	}
+}
+
+// A binding is the result of routing a client to a target.
+type binding struct {
+	backend  RoundTripper // The MDC host, or virtual variables.
+	client   netip.Addr
+	mdc      *conn.Conn
+	policy   *Policy
+	shadow   *Policy // Nil if no shadow policy applies to the client.
+	shadowed bool    // Set if the target has shadow policies.
+	target   *Target
+	virtual  *virtualBackend // Nil if the target has no virtual variables.
+	who      *principal      // Nil if unauthenticated.
+}
+
+// request constructs the input for an access check. The state caches
+// responses from the MDC host for interlocks.
+func (b *binding) request(cmd message.Command, state RoundTripper) *Request {
+	if b.virtual != nil {
+		state = &virtualBackend{next: state, store: b.virtual.store, config: b.virtual.config}
+	}
+	req := &Request{
+		Backend: b.backend,
+		Client:  b.client,
+		Command: cmd,
+		State:   state,
+		Tags:    b.target.Tags,
+		Target:  b.mdc.Addr(),
+		Time:    time.Now(),
+	}
+	if b.who != nil {
+		req.Groups = b.who.groups
+		req.Principal = b.who.name
+	}
+	return req
+}
+
+// compareShadow evaluates the shadow policy and logs the request if its
+// decision differs from that of the enforced policy.
+func (b *binding) compareShadow(
+	ctx context.Context, logger *slog.Logger, req *Request, allowed bool, reason string,
+) {
+	shadowAllowed, shadowReason := false, denyNoPolicy
+	if b.shadow != nil {
+		shadowAllowed, shadowReason = b.shadow.Allow(ctx, req)
+	}
+	if shadowAllowed == allowed {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.Bool("audit", true),
+		slog.Any("request", req.Command),
+		slog.Bool("allow", allowed),
+		slog.Bool("shadow_allow", shadowAllowed),
+	}
+	if allowed {
+		attrs = append(attrs, slog.String("shadow_reason", shadowReason))
+	} else {
+		attrs = append(attrs, slog.String("reason", reason))
+	}
+	logger.LogAttrs(ctx, slog.LevelInfo, "shadow policy differs", attrs...)
+}
+
+// compareUnrouted logs a request which no enforced policy routes if a shadow
+// policy would allow it. The line is nil when a new connection is dropped.
+func (p *Proxy) compareUnrouted(
+	ctx context.Context,
+	logger *slog.Logger,
+	route *listenerRoute,
+	client netip.Addr,
+	creds *credentials,
+	line []byte,
+) {
+	if route == nil {
+		return
+	}
+	b := route.bind(client, creds)
+	if b.shadow == nil {
+		return
 	}
+	attrs := []slog.Attr{
+		slog.Bool("audit", true),
+		slog.Bool("allow", false),
+		slog.Bool("shadow_allow", true),
+		slog.String("reason", denyNoPolicy),
+	}
+	if line != nil {
+		symbolic := isSymbolic(line)
+		if symbolic {
+			resolved, err := b.target.symbols.resolve(line)
+			if err != nil {
+				return
+			}
+			line = resolved
+		}
+		cmd, err := message.ParseCommand(line)
+		if err != nil {
+			return
+		}
+		if remapped, ok := b.shadow.remap(cmd); ok && !symbolic {
+			cmd = remapped
+		}
+		if ok, _ := b.shadow.Allow(ctx, b.request(cmd, p.machineState(b.mdc))); !ok {
+			return
+		}
+		attrs = append(attrs, slog.Any("request", cmd))
+	}
+	logger.LogAttrs(ctx, slog.LevelInfo, "shadow policy differs", attrs...)
+}
+
+func (r *listenerRoute) get(client netip.Addr, creds *credentials) (*binding, bool) {
+	b := r.bind(client, creds)
+	return b, b.policy != nil
 }
 
-func (r *listenerRoute) get(client netip.Addr) (*conn.Conn, *Policy, bool) {
+// bind routes the client to the target. The binding's policy is nil if no
+// enforced policy applies to the client, although a shadow policy may.
+func (r *listenerRoute) bind(client netip.Addr, creds *credentials) *binding {
 	r.mu.RLock()
+	cfg := r.mu.cfg
 	mdc := r.mu.mdc
-	policies := r.mu.policies
+	target := r.mu.target
+	virtual := r.mu.virtual
 	r.mu.RUnlock()
 
-	for _, policy := range policies {
-		if policy.Contains(client) {
-			return mdc, policy.Policy, true
-		}
+	who, _ := cfg.authenticate(creds, client)
+	now := time.Now()
+	policy, _ := target.PolicyFor(client, who, now)
+	b := &binding{backend: mdc, client: client, mdc: mdc, policy: policy, target: target, who: who}
+	if virtual != nil && target.Virtual != nil {
+		b.virtual = &virtualBackend{next: mdc, store: virtual, config: target.Virtual}
+		b.backend = b.virtual
+	}
+	if target.shadow != nil {
+		b.shadow, _ = target.shadow.PolicyFor(client, who, now)
+		b.shadowed = true
+	}
+	return b
+}
+
+// target returns the hostname and configuration of the route's target.
+func (r *listenerRoute) target() (string, *Target) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.mu.mdc.Addr(), r.mu.target
+}
+
+// tls returns the TLS configuration to use for new connections, or nil if
+// TLS is not enabled.
+func (r *listenerRoute) tls() *tls.Config {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if t := r.mu.target.tls; t != nil {
+		return t.config
 	}
-	return nil, nil, false
+	return nil
 }
 
 func New(ctx *stopper.Context, cfg *notify.Var[*Config]) (*Proxy, error) {
 	p := &Proxy{cfg: cfg}
 	p.mu.connByHostname = make(map[string]*conn.Conn)
+	p.mu.stateByHostname = make(map[string]*machineState)
+	p.mu.virtualByHostname = make(map[string]*virtualStore)
 	p.mu.listeners = make(map[netip.AddrPort]*net.TCPListener)
 	p.mu.routes = make(map[*net.TCPListener]*listenerRoute)
+	p.budgets.byHostname = make(map[string]*rateWindow)
+	p.sessions.byClient = make(map[netip.Addr]int)
+	p.sessions.byRoute = make(map[*listenerRoute]int)
+	p.sweepBans(ctx)
 
 	ctx.Go(func(ctx *stopper.Context) error {
 		_, err := notifyx.DoWhenChanged(ctx, nil, cfg, func(ctx *stopper.Context, _, cfg *Config) error {
 			slog.DebugContext(ctx, "updating configuration")
-			cfg.expandPolicy()
+			if err := cfg.Expand(); err != nil {
+				slog.ErrorContext(ctx, "invalid configuration, not reconfiguring",
+					slog.Any("error", err))
+				return nil
+			}
 
 			p.mu.Lock()
 			defer p.mu.Unlock()
 
+			nextJournal := p.mu.journal
+			if nextJournal == nil || nextJournal.path != cfg.Journal {
+				nextJournal = nil
+				if cfg.Journal != "" {
+					var err error
+					nextJournal, err = openJournal(cfg.Journal)
+					if err != nil {
+						slog.ErrorContext(ctx, "could not open journal, not reconfiguring",
+							slog.String("journal", cfg.Journal),
+							slog.Any("error", err))
+						return nil
+					}
+				}
+			}
+
+			nextVirtual := make(map[string]*virtualStore)
+			for hostname, target := range cfg.Targets {
+				if target.Virtual == nil {
+					continue
+				}
+				store := p.mu.virtualByHostname[hostname]
+				if store == nil || store.path != target.Virtual.File {
+					var err error
+					store, err = openVirtual(target.Virtual.File)
+					if err != nil {
+						slog.ErrorContext(ctx, "could not load virtual variables, not reconfiguring",
+							slog.String("hostname", hostname),
+							slog.Any("error", err))
+						if nextJournal != nil && nextJournal != p.mu.journal {
+							nextJournal.close()
+						}
+						return nil
+					}
+				}
+				nextVirtual[hostname] = store
+			}
+
 			nextConns := make(map[string]*conn.Conn)
+			nextStates := make(map[string]*machineState)
 			nextListeners := make(map[netip.AddrPort]*net.TCPListener)
 			nextRoutes := make(map[*net.TCPListener]*listenerRoute)
 
@@ -106,6 +341,13 @@ func New(ctx *stopper.Context, cfg *notify.Var[*Config]) (*Proxy, error) {
 				}
 				nextConns[hostname] = c
 
+				state := p.mu.stateByHostname[hostname]
+				if state == nil {
+					state = newMachineState(c)
+				}
+				state.setTTL(cfg.InterlockCache)
+				nextStates[hostname] = state
+
 				// Find existing listener, or create one.
 				addrPort := netip.AddrPortFrom(cfg.Bind, target.ProxyPort)
 				l := p.mu.listeners[addrPort]
@@ -118,6 +360,9 @@ func New(ctx *stopper.Context, cfg *notify.Var[*Config]) (*Proxy, error) {
 							slog.String("hostname", hostname),
 							slog.String("addrPort", addrPort.String()),
 							slog.Any("error", err))
+						if nextJournal != nil && nextJournal != p.mu.journal {
+							nextJournal.close()
+						}
 						return nil
 					}
 					slog.DebugContext(ctx, "proxy listening",
@@ -134,12 +379,29 @@ func New(ctx *stopper.Context, cfg *notify.Var[*Config]) (*Proxy, error) {
 				nextRoutes[l] = r
 
 				r.mu.Lock()
+				r.mu.cfg = cfg
 				r.mu.mdc = c
-				r.mu.policies = target.ordered
+				r.mu.target = target
+				r.mu.virtual = nextVirtual[hostname]
 				r.mu.Unlock()
 
 			}
 
+			// Restart the admin interface if it has moved.
+			if admin := p.mu.admin; admin != nil && (cfg.Admin == nil || !admin.matches(cfg.Admin)) {
+				_ = admin.srv.Close()
+				p.mu.admin = nil
+			}
+			if cfg.Admin != nil && p.mu.admin == nil {
+				admin, err := p.serveAdmin(ctx, cfg.Admin)
+				if err != nil {
+					slog.ErrorContext(ctx, "could not start admin interface",
+						slog.String("addrPort", cfg.Admin.Addr.String()),
+						slog.Any("error", err))
+				}
+				p.mu.admin = admin
+			}
+
 			// Close unreferenced listeners.
 			for listenAddr, oldListener := range p.mu.listeners {
 				if nextListeners[listenAddr] == nil {
@@ -148,7 +410,15 @@ func New(ctx *stopper.Context, cfg *notify.Var[*Config]) (*Proxy, error) {
 				}
 			}
 
+			if p.mu.journal != nil && p.mu.journal != nextJournal {
+				p.mu.journal.close()
+			}
+
+			p.mu.active = cfg
+			p.mu.journal = nextJournal
 			p.mu.connByHostname = nextConns
+			p.mu.stateByHostname = nextStates
+			p.mu.virtualByHostname = nextVirtual
 			p.mu.listeners = nextListeners
 			p.mu.routes = nextRoutes
 
@@ -162,6 +432,12 @@ func New(ctx *stopper.Context, cfg *notify.Var[*Config]) (*Proxy, error) {
 		for _, listener := range p.mu.listeners {
 			_ = listener.Close()
 		}
+		if p.mu.admin != nil {
+			_ = p.mu.admin.srv.Close()
+		}
+		if p.mu.journal != nil {
+			p.mu.journal.close()
+		}
 
 		return err
 	})
@@ -178,45 +454,168 @@ func (p *Proxy) accept(ctx *stopper.Context, listener *net.TCPListener) {
 				return nil
 			}
 
-			client := tcpConn.RemoteAddr().(*net.TCPAddr).AddrPort()
+			client := remoteAddr(tcpConn)
 			logger := slog.With(
 				slog.Any("client", client),
 				slog.Any("listener", tcpConn.LocalAddr()))
 
-			// Allow late-binding of policies to reflect configuration file
-			// changes.
-			router := func() (*conn.Conn, *Policy, bool) {
-				return p.policyFor(listener, client.Addr())
+			if p.bans.banned(client.Addr()) {
+				auditReject(ctx, logger, rejectBanned)
+				_ = tcpConn.Close()
+				continue
 			}
 
-			// Immediately drop connections that we cannot route.
-			if _, _, ok := router(); !ok {
+			route := p.route(listener)
+			if route == nil {
+				_ = tcpConn.Close()
+				continue
+			}
+			tlsConfig := route.tls()
+
+			// Immediately drop connections that we cannot route. A client
+			// certificate may provide a route once the TLS handshake has
+			// completed, or the client may send an XAUTH command.
+			if _, ok := route.get(client.Addr(), nil); !ok &&
+				(tlsConfig == nil || tlsConfig.ClientCAs == nil) &&
+				!p.config().acceptsTokens() {
 				logger.DebugContext(ctx, "no route for connection")
+				p.compareUnrouted(ctx, logger, route, client.Addr(), nil, nil)
+				p.bans.fail(ctx, p.config().Ban, client.Addr(), failNoRoute)
+				_ = tcpConn.Close()
+				continue
+			}
+
+			// Enforce concurrent session limits.
+			release, reason := p.admit(route, client.Addr())
+			if reason != "" {
+				auditReject(ctx, logger, reason)
+				if tlsConfig == nil {
+					_ = tcpConn.SetWriteDeadline(time.Now().Add(time.Second))
+					_, _ = fmt.Fprintf(tcpConn, "%c?, MDCMUX %s%s", message.Prompt,
+						strings.ToUpper(reason), message.EOL)
+				}
 				_ = tcpConn.Close()
 				continue
 			}
 
 			// Service the individual connection.
-			ctx.Go(func(ctx *stopper.Context) error {
-				if err := p.proxy(ctx, logger, tcpConn, router); err != nil {
+			if !ctx.Go(func(ctx *stopper.Context) error {
+				defer release()
+				if err := p.proxy(ctx, logger, tcpConn, listener, tlsConfig); err != nil {
 					logger.ErrorContext(ctx, "could not proxy connection", "error", err)
 				}
 				return nil
-			})
+			}) {
+				release()
+				_ = tcpConn.Close()
+			}
 		}
 	})
 }
 
+// remoteAddr returns the address of the client. IPv4 clients of a dual-stack
+// listener are reported as IPv4 addresses, so that bans, session limits, and
+// policies apply regardless of the listener.
+func remoteAddr(tcpConn *net.TCPConn) netip.AddrPort {
+	addr := tcpConn.RemoteAddr().(*net.TCPAddr).AddrPort()
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
+
 func (p *Proxy) proxy(ctx *stopper.Context,
 	logger *slog.Logger,
 	tcpConn *net.TCPConn,
-	router func() (mdc *conn.Conn, policy *Policy, ok bool)) error {
-	defer func() { _ = tcpConn.Close() }()
+	listener *net.TCPListener,
+	tlsConfig *tls.Config,
+) error {
+	var netConn net.Conn = tcpConn
+	defer func() { _ = netConn.Close() }()
+
+	cfg := p.config()
+
+	// Client identities are derived from a TLS client certificate or from an
+	// XAUTH command.
+	creds := &credentials{}
+	if tlsConfig != nil {
+		tlsConn := tls.Server(tcpConn, tlsConfig)
+		netConn = tlsConn
+
+		_ = tcpConn.SetDeadline(time.Now().Add(cfg.FirstCommandTimeout))
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			auditReject(ctx, logger, rejectHandshake, slog.Any("error", err))
+			return nil
+		}
+		_ = tcpConn.SetDeadline(time.Time{})
+
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			creds.identities = certIdentities(certs[0])
+			logger = logger.With(slog.Any("identities", creds.identities))
+		}
+	}
+
+	// Refuse connections to offline targets with a banner, rather than
+	// resetting the connection.
+	if route := p.route(listener); route != nil {
+		hostname, target := route.target()
+		if p.modeFor(ctx, hostname, target) == ModeOffline {
+			logger.DebugContext(ctx, "target offline")
+			_ = tcpConn.SetWriteDeadline(time.Now().Add(time.Second))
+			_, _ = fmt.Fprintf(netConn, "%c%s%s", message.Prompt, offlineBanner, message.EOL)
+			return nil
+		}
+	}
 
-	in := bufio.NewScanner(tcpConn)
-	out := bufio.NewWriter(tcpConn)
+	// Allow late-binding of policies to reflect configuration file changes.
+	client := remoteAddr(tcpConn)
+	router := func() (*binding, bool) {
+		return p.policyFor(listener, client.Addr(), creds)
+	}
+	if _, ok := router(); !ok && !cfg.acceptsTokens() {
+		logger.DebugContext(ctx, "no route for connection")
+		p.compareUnrouted(ctx, logger, p.route(listener), client.Addr(), creds, nil)
+		p.bans.fail(ctx, cfg.Ban, client.Addr(), failNoRoute)
+		return nil
+	}
+
+	in := bufio.NewScanner(netConn)
+	in.Buffer(make([]byte, 0, cfg.MaxLineLength), cfg.MaxLineLength)
+	out := bufio.NewWriter(netConn)
 	defer func() { _ = out.Flush() }()
 
+	// A client without a route may only authenticate, so it has less time
+	// in which to do so.
+	_, routed := router()
+	firstCommand := cfg.FirstCommandTimeout
+	if !routed {
+		firstCommand = min(firstCommand, cfg.AuthTimeout)
+	}
+
+	sess := newSession(ctx, netConn, firstCommand, cfg.MaxIdle)
+	logger = logger.With(slog.String("session", sess.id))
+	sess.client = client.Addr()
+	sess.creds = creds
+	sess.logger = logger
+	sess.out = out
+	sess.router = router
+	sess.unrouted = func(ctx context.Context, line []byte) {
+		p.compareUnrouted(ctx, logger, p.route(listener), client.Addr(), creds, line)
+	}
+	defer sess.close()
+
+	// A connection which was accepted so that the client could authenticate
+	// counts as unroutable if the session never obtains a route.
+	if !routed {
+		defer func() {
+			if !sess.routed && !sess.failed {
+				p.fail(ctx, sess, failNoRoute)
+			}
+		}()
+	}
+
+	// Apply the session lifetime from the initial policy.
+	if b, ok := router(); ok {
+		sess.ready(b.policy)
+	}
+
 	// Write the initial greeting prompt.
 	if err := message.WritePrompt(out); err != nil {
 		return err
@@ -224,134 +623,324 @@ func (p *Proxy) proxy(ctx *stopper.Context,
 
 	// Updated at the bottom of the loop.
 	idleSince := time.Now()
-	for {
-		if ctx.IsStopping() {
-			return nil
-		}
+	for in.Scan() {
+		sess.busy()
 
-		// Impose maximum connection idle time behavior.
-		cfg, _ := p.cfg.Get()
-		if time.Since(idleSince) >= cfg.MaxIdle {
-			logger.DebugContext(ctx, "dropping idle connection")
-			return nil
+		// Record time between client requests.
+		clientLatency := time.Since(idleSince)
+
+		if ok, err := p.handle(ctx, sess, in.Bytes(), clientLatency); err != nil || !ok {
+			return err
 		}
 
-		// Set read deadlines to allow clean shutdown.
-		_ = tcpConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
-		didScan := in.Scan()
+		idleSince = time.Now()
 
-		if err := in.Err(); err != nil {
-			if errors.Is(err, io.EOF) {
-				return nil
-			}
-			if netErr := (net.Error)(nil); errors.As(err, &netErr) && netErr.Timeout() {
-				in = bufio.NewScanner(tcpConn)
-				continue
-			}
-			return err
+		// Pick up any changes to the session timeouts.
+		b, ok := router()
+		if !ok {
+			logger.DebugContext(ctx, "no route found")
+			return nil
 		}
+		sess.ready(b.policy)
+	}
 
-		if !didScan {
-			continue
+	// Timers or shutdown will interrupt a blocked read.
+	if reason := sess.interrupted(); reason != nil {
+		switch {
+		case errors.Is(reason, errNoCommand):
+			auditReject(ctx, logger, rejectNoCommand)
+		case errors.Is(reason, errExpired), errors.Is(reason, errIdle):
+			logger.DebugContext(ctx, "session expired", slog.Any("reason", reason))
+			// Don't let an unresponsive client block the session.
+			_ = netConn.SetWriteDeadline(time.Now().Add(time.Second))
+			_ = message.WriteResponse(out, "?, MDCMUX SESSION EXPIRED")
+		default:
+			logger.DebugContext(ctx, "closing session", slog.Any("reason", reason))
 		}
+		return nil
+	}
+	// The error will be nil on a clean EOF.
+	err := in.Err()
+	if errors.Is(err, bufio.ErrTooLong) {
+		auditReject(ctx, logger, rejectLineTooLong)
+		return message.WriteResponse(out, "?, MDCMUX LINE TOO LONG")
+	}
+	return err
+}
 
-		// Record time between client requests.
-		clientLatency := time.Since(idleSince)
+// handle processes a single line of client input. It returns false if the
+// session should be terminated.
+func (p *Proxy) handle(
+	ctx *stopper.Context, sess *session, line []byte, clientLatency time.Duration,
+) (bool, error) {
+	out := sess.out
 
-		// Ignore empty lines.
-		if len(in.Bytes()) == 0 {
-			continue
-		}
+	// Ignore empty lines.
+	if len(line) == 0 {
+		return true, nil
+	}
 
-		// We now have a message to parse.
-		msg, err := message.ParseCommand(in.Bytes())
-		if err != nil {
-			logger.DebugContext(ctx, "could not parse message",
-				"error", err)
-			return err
-		}
+	// Drop existing sessions once a client has been banned.
+	if p.bans.banned(sess.client) {
+		auditReject(ctx, sess.logger, rejectBanned)
+		return false, nil
+	}
 
-		// Look up the route on each incoming message. This prevents old
-		// connections from retaining stale policies.
-		mdc, policy, ok := router()
+	// Authentication is handled by the proxy.
+	if isXAuth(line) {
+		sess.commanded()
+		return p.xauth(ctx, sess, line)
+	}
 
-		// Deconfigured.
+	// Symbolic names are resolved with the target's symbol table. Symbols
+	// refer to the MDC host's variables, so they are not remapped.
+	symbolic := isSymbolic(line)
+	if symbolic {
+		b, ok := sess.router()
 		if !ok {
-			logger.DebugContext(ctx, "no route found")
-			return nil
+			sess.logger.DebugContext(ctx, "no route found")
+			sess.unrouted(ctx, line)
+			p.fail(ctx, sess, failNoRoute)
+			return false, nil
+		}
+		resolved, err := b.target.symbols.resolve(line)
+		if err != nil {
+			sess.logger.DebugContext(ctx, "could not resolve symbol", "error", err)
+			return true, message.WriteResponse(out, "?, MDCMUX UNKNOWN SYMBOL")
 		}
+		line = resolved
+	}
+
+	// We now have a message to parse.
+	msg, err := message.ParseCommand(line)
+	if err != nil {
+		sess.logger.DebugContext(ctx, "could not parse message",
+			"error", err)
+		p.fail(ctx, sess, failParseError)
+		return false, err
+	}
+	sess.commanded()
+
+	// Look up the route on each incoming message. This prevents old
+	// connections from retaining stale policies.
+	b, ok := sess.router()
+
+	// Deconfigured.
+	if !ok {
+		sess.logger.DebugContext(ctx, "no route found")
+		sess.unrouted(ctx, line)
+		p.fail(ctx, sess, failNoRoute)
+		return false, nil
+	}
+	sess.routed = true
+	mdc, policy := b.mdc, b.policy
 
-		logger := logger.With(slog.String("backend", mdc.Addr()))
+	logger := sess.logger.With(slog.String("backend", mdc.Addr()))
+	if b.who != nil {
+		logger = logger.With(slog.Any("principal", b.who))
+	}
+
+	// Access checks, logging, and the MDC host use the remapped variables.
+	if remapped, ok := policy.remap(msg); ok && !symbolic {
+		logger = logger.With(slog.Any("client_request", msg))
+		msg = remapped
+	}
+
+	var symbol *Symbol
+	if v, ok := msg.Variable(); ok && v.Frac() == 0 {
+		var name string
+		if name, symbol, ok = b.target.symbols.Name(int(v.Whole())); ok {
+			logger = logger.With(slog.String("symbol", name))
+		}
+	}
 
-		var auditData []slog.Attr
-		if policy.Audit {
-			auditData = append(make([]slog.Attr, 0, 16),
+	switch p.modeFor(ctx, mdc.Addr(), b.target) {
+	case ModeOffline:
+		logger.DebugContext(ctx, "target offline")
+		_ = message.WriteResponse(out, offlineBanner)
+		return false, nil
+	case ModeReadOnly:
+		if msg.IsWrite() {
+			logger.LogAttrs(ctx, slog.LevelInfo, "deny",
 				slog.Bool("audit", true),
 				slog.Any("request", msg),
-			)
+				slog.Bool("deny", true),
+				slog.String("reason", denyReadOnly))
+			return true, message.WriteResponse(out, "?, MDCMUX READ ONLY")
 		}
+	}
 
-		// A failed access check doesn't kill the connection.
-		if !policy.Allow(msg) {
-			if len(auditData) > 0 {
-				auditData = append(auditData, slog.Bool("deny", true))
-				logger.LogAttrs(ctx, slog.LevelInfo, "deny", auditData...)
-			}
-			if err := message.WriteResponse(out, "?, MDCMUX DENY POLICY"); err != nil {
-				return err
-			}
-			continue
-		}
+	if value, ok := msg.Value(); ok && msg.IsWrite() && symbol != nil && !symbol.accepts(value) {
+		logger.LogAttrs(ctx, slog.LevelInfo, "deny",
+			slog.Bool("audit", true),
+			slog.Any("request", msg),
+			slog.Bool("deny", true),
+			slog.String("reason", denySymbolType))
+		return true, message.WriteResponse(out, "?, MDCMUX INVALID VALUE")
+	}
 
-		// Proxy the message across.
-		writeStart := time.Now()
-		resp, err := mdc.RoundTrip(ctx, msg)
-		if err != nil {
-			// Internal error, drop the connection.
-			_ = message.WriteResponse(out, "?, MDCMUX PROXY ERROR")
-			return err
-		}
-		flushStart := time.Now()
-		if _, err := out.WriteRune(message.Prompt); err != nil {
-			return err
-		}
-		if _, err := resp.WriteTo(out); err != nil {
-			return err
+	var auditData []slog.Attr
+	if policy.Audit {
+		auditData = append(make([]slog.Attr, 0, 16),
+			slog.Bool("audit", true),
+			slog.Any("request", msg),
+		)
+	}
+
+	// A failed access check doesn't kill the connection.
+	state := p.machineState(mdc)
+	req := b.request(msg, state)
+	ok, reason := policy.Allow(ctx, req)
+	if b.shadowed {
+		b.compareShadow(ctx, logger, req, ok, reason)
+	}
+	if !ok {
+		// Rejected writes are always audited.
+		if len(auditData) > 0 || msg.IsWrite() {
+			logger.LogAttrs(ctx, slog.LevelInfo, "deny",
+				slog.Bool("audit", true),
+				slog.Any("request", msg),
+				slog.Bool("deny", true),
+				slog.String("reason", reason))
 		}
-		if _, err := out.WriteString("\r\n"); err != nil {
-			return err
+		p.fail(ctx, sess, failDenied)
+		return true, message.WriteResponse(out, "?, MDCMUX DENY POLICY")
+	}
+
+	if reason := p.throttle(ctx, logger, sess, b, msg); reason != "" {
+		logger.LogAttrs(ctx, slog.LevelInfo, "deny",
+			slog.Bool("audit", true),
+			slog.Any("request", msg),
+			slog.Bool("deny", true),
+			slog.String("reason", reason))
+		return true, message.WriteResponse(out, "?, MDCMUX WRITE LIMIT")
+	}
+
+	// Proxy the message across.
+	sess.proxied = true
+	if approval := policy.approvalFor(msg); approval != nil {
+		return p.hold(ctx, sess, logger, b, msg, approval)
+	}
+	if reason := p.journalWrite(ctx, logger, b, sess.id, msg); reason != "" {
+		logger.LogAttrs(ctx, slog.LevelWarn, "journal",
+			slog.Bool("audit", true),
+			slog.Any("request", msg),
+			slog.String("reason", reason))
+		return true, message.WriteResponse(out, "?, MDCMUX JOURNAL ERROR")
+	}
+	writeStart := time.Now()
+	resp, err := b.backend.RoundTrip(ctx, msg)
+	if err != nil {
+		// Internal error, drop the connection.
+		_ = message.WriteResponse(out, "?, MDCMUX PROXY ERROR")
+		return false, err
+	}
+	if msg.IsWrite() {
+		state.reset()
+		if !verifyWrite(ctx, logger, b, msg, resp) {
+			return true, message.WriteResponse(out, "?, MDCMUX VERIFY FAILED")
 		}
-		// Write next-command prompt. This will also flush the buffer.
-		if err := message.WritePrompt(out); err != nil {
-			return err
+	}
+	flushStart := time.Now()
+	if err := writeProxied(out, policy.redact(msg, resp)); err != nil {
+		return false, err
+	}
+	flushEnd := time.Now()
+
+	if len(auditData) > 0 {
+		auditData = append(auditData,
+			slog.Group("latency",
+				slog.Duration("backend", flushStart.Sub(writeStart)),
+				slog.Duration("client", clientLatency),
+				slog.Duration("flush", flushEnd.Sub(flushStart)),
+			),
+			slog.Any("response", resp),
+		)
+		logger.LogAttrs(ctx, slog.LevelInfo, "proxy", auditData...)
+	}
+	return true, nil
+}
+
+// writeProxied writes a response from the MDC host to the client, followed by
+// the next-command prompt.
+func writeProxied(out *bufio.Writer, resp message.Response) error {
+	if _, err := out.WriteRune(message.Prompt); err != nil {
+		return err
+	}
+	if _, err := resp.WriteTo(out); err != nil {
+		return err
+	}
+	if _, err := out.WriteString("\r\n"); err != nil {
+		return err
+	}
+	// Write next-command prompt. This will also flush the buffer.
+	return message.WritePrompt(out)
+}
+
+// admit checks the concurrent session limits for a new client connection. If
+// the session is admitted, the returned function must be called once the
+// session has ended. Otherwise, a rejection reason will be returned.
+func (p *Proxy) admit(route *listenerRoute, client netip.Addr) (release func(), reason string) {
+	cfg := p.config()
+
+	route.mu.RLock()
+	maxSessions := route.mu.target.MaxSessions
+	route.mu.RUnlock()
+
+	p.sessions.Lock()
+	defer p.sessions.Unlock()
+
+	if limit := cfg.MaxSessionsPerClient; limit > 0 && p.sessions.byClient[client] >= limit {
+		return nil, rejectClientLimit
+	}
+	if maxSessions > 0 && p.sessions.byRoute[route] >= maxSessions {
+		return nil, rejectSessionLimit
+	}
+	p.sessions.byClient[client]++
+	p.sessions.byRoute[route]++
+
+	return func() {
+		p.sessions.Lock()
+		defer p.sessions.Unlock()
+		if p.sessions.byClient[client]--; p.sessions.byClient[client] <= 0 {
+			delete(p.sessions.byClient, client)
 		}
-		flushEnd := time.Now()
-
-		if len(auditData) > 0 {
-			auditData = append(auditData,
-				slog.Group("latency",
-					slog.Duration("backend", flushStart.Sub(writeStart)),
-					slog.Duration("client", clientLatency),
-					slog.Duration("flush", flushEnd.Sub(flushStart)),
-				),
-				slog.Any("response", resp),
-			)
-			logger.LogAttrs(ctx, slog.LevelInfo, "proxy", auditData...)
+		if p.sessions.byRoute[route]--; p.sessions.byRoute[route] <= 0 {
+			delete(p.sessions.byRoute, route)
 		}
+	}, ""
+}
 
-		idleSince = time.Now()
-	}
+// config returns the most recently applied configuration.
+func (p *Proxy) config() *Config {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.mu.active
 }
 
-func (p *Proxy) policyFor(l *net.TCPListener, client netip.Addr) (
-	backend *conn.Conn, policy *Policy, ok bool,
-) {
+// machineState returns the cached state associated with the connection. An
+// uncached instance is returned if the connection has been deconfigured.
+func (p *Proxy) machineState(mdc *conn.Conn) *machineState {
 	p.mu.RLock()
-	route := p.mu.routes[l]
+	state := p.mu.stateByHostname[mdc.Addr()]
 	p.mu.RUnlock()
+	if state == nil {
+		state = newMachineState(mdc)
+	}
+	return state
+}
 
+func (p *Proxy) policyFor(l *net.TCPListener, client netip.Addr, creds *credentials) (*binding, bool) {
+	route := p.route(l)
 	if route == nil {
-		return nil, nil, false
+		return nil, false
 	}
-	return route.get(client)
+	return route.get(client, creds)
+}
+
+// route returns the current route for the listener, if one is configured.
+func (p *Proxy) route(l *net.TCPListener) *listenerRoute {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.mu.routes[l]
 }
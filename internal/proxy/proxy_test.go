@@ -23,13 +23,19 @@
 package proxy
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/netip"
+	"runtime"
+	"runtime/metrics"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"vawter.tech/mdcmux/internal/mdctest"
@@ -37,6 +43,7 @@ import (
 	"vawter.tech/mdcmux/pkg/dummy"
 	"vawter.tech/mdcmux/pkg/message"
 	"vawter.tech/notify"
+	"vawter.tech/stopper"
 )
 
 func TestProxy(t *testing.T) {
@@ -66,31 +73,7 @@ func TestProxy(t *testing.T) {
 		},
 	})
 
-	p, err := New(ctx, cfg)
-	r.NoError(err)
-
-	var pConn *conn.Conn
-	for {
-		p.mu.RLock()
-		_, reconfigured := p.reconfigured.Get()
-		bindings := p.mu.listeners
-		p.mu.RUnlock()
-
-		if len(bindings) == 0 {
-			select {
-			case <-ctx.Stopping():
-				r.Fail("never saw configuration update")
-			case <-reconfigured:
-				continue
-			}
-		}
-
-		r.Len(bindings, 1)
-		for _, b := range bindings {
-			pConn = conn.New(b.Addr().String())
-		}
-		break
-	}
+	p, pConn := startProxy(t, ctx, cfg)
 
 	check := func(r *require.Assertions, expected string, msg message.Command) {
 		resp, err := pConn.RoundTrip(ctx, msg)
@@ -143,3 +126,303 @@ func TestProxy(t *testing.T) {
 		}
 	})
 }
+
+func TestProxyInterlocks(t *testing.T) {
+	r := require.New(t)
+
+	ctx := mdctest.NewStopperForTest(t)
+
+	d, err := dummy.New(ctx, "127.0.0.1:0")
+	r.NoError(err)
+
+	cfg := notify.VarOf(&Config{
+		Bind: netip.AddrFrom4([4]byte{127, 0, 0, 1}),
+		Policy: map[netip.Prefix]*Policy{
+			netip.MustParsePrefix("127.0.0.1/32"): {
+				AllowWrites: [][2]int{{1, 33}},
+				Interlocks: []*Interlock{
+					{Variables: [2]int{33, 33}, NotMode: []string{"STARTUP_MODE"}},
+				},
+			},
+		},
+		Targets: map[string]*Target{
+			d.Addr().String(): {},
+		},
+	})
+	_, pConn := startProxy(t, ctx, cfg)
+
+	check := func(expected string, msg message.Command) {
+		resp, err := pConn.RoundTrip(ctx, msg)
+		r.NoError(err)
+		r.Equal(expected, resp.(fmt.Stringer).String())
+	}
+
+	// The dummy server is always in its startup mode.
+	check("?, MDCMUX DENY POLICY", message.WriteCommand(message.Int64(33), message.Int64(1)))
+	check("!", message.WriteCommand(message.Int64(32), message.Int64(1)))
+}
+
+func TestIdleTimeout(t *testing.T) {
+	r := require.New(t)
+
+	ctx := mdctest.NewStopperForTest(t)
+
+	d, err := dummy.New(ctx, "127.0.0.1:0")
+	r.NoError(err)
+
+	cfg := notify.VarOf(&Config{
+		Bind:    netip.AddrFrom4([4]byte{127, 0, 0, 1}),
+		MaxIdle: 100 * time.Millisecond,
+		Targets: map[string]*Target{
+			d.Addr().String(): {},
+		},
+	})
+	_, pConn := startProxy(t, ctx, cfg)
+
+	// Make sure the connection is established.
+	resp, err := pConn.RoundTrip(ctx, message.CommandMachineModel)
+	r.NoError(err)
+	r.Equal("MODEL, MDCMUX", resp.String())
+
+	// The proxy should close the session once it has been idle.
+	raw := dialProxy(t, pConn.Addr())
+	start := time.Now()
+	buf, err := io.ReadAll(raw)
+	r.NoError(err)
+	r.Less(time.Since(start), 5*time.Second)
+	r.Equal(">?, MDCMUX SESSION EXPIRED\r\n>", string(buf))
+}
+
+func TestSessionLifetime(t *testing.T) {
+	r := require.New(t)
+
+	ctx := mdctest.NewStopperForTest(t)
+
+	d, err := dummy.New(ctx, "127.0.0.1:0")
+	r.NoError(err)
+
+	cfg := notify.VarOf(&Config{
+		Bind: netip.AddrFrom4([4]byte{127, 0, 0, 1}),
+		Policy: map[netip.Prefix]*Policy{
+			netip.MustParsePrefix("127.0.0.1/32"): {
+				MaxSession: 250 * time.Millisecond,
+			},
+		},
+		Targets: map[string]*Target{
+			d.Addr().String(): {},
+		},
+	})
+	_, pConn := startProxy(t, ctx, cfg)
+
+	sess := dialSession(t, pConn.Addr())
+	start := time.Now()
+
+	// Activity does not extend the session lifetime.
+	for range 3 {
+		r.Equal("MODEL, MDCMUX", sess.send("?Q102"))
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	reply, ok := sess.reply()
+	r.True(ok)
+	r.Equal("?, MDCMUX SESSION EXPIRED", reply)
+	r.GreaterOrEqual(time.Since(start), 250*time.Millisecond)
+}
+
+func TestSlowClientProtections(t *testing.T) {
+	r := require.New(t)
+
+	ctx := mdctest.NewStopperForTest(t)
+
+	d, err := dummy.New(ctx, "127.0.0.1:0")
+	r.NoError(err)
+
+	cfg := notify.VarOf(&Config{
+		Bind:                 netip.AddrFrom4([4]byte{127, 0, 0, 1}),
+		FirstCommandTimeout:  100 * time.Millisecond,
+		MaxLineLength:        16,
+		MaxSessionsPerClient: 1,
+		Targets: map[string]*Target{
+			d.Addr().String(): {},
+		},
+	})
+	_, pConn := startProxy(t, ctx, cfg)
+
+	t.Run("first_command", func(t *testing.T) {
+		r := require.New(t)
+		raw := dialProxy(t, pConn.Addr())
+		_, err := io.ReadAll(raw)
+		r.NoError(err)
+	})
+
+	t.Run("first_command_empty_lines", func(t *testing.T) {
+		r := require.New(t)
+		raw := dialProxy(t, pConn.Addr())
+		// Empty lines do not satisfy the first-command timeout.
+		for range 4 {
+			_, err := io.WriteString(raw, "\r\n")
+			r.NoError(err)
+			time.Sleep(20 * time.Millisecond)
+		}
+		r.NoError(raw.SetReadDeadline(time.Now().Add(time.Second)))
+		_, err := io.ReadAll(raw)
+		r.NoError(err)
+	})
+
+	t.Run("line_length", func(t *testing.T) {
+		r := require.New(t)
+		raw := dialProxy(t, pConn.Addr())
+		// Fill the buffer exactly, since the proxy will reset the
+		// connection if there is unread data when it closes.
+		_, err := fmt.Fprintf(raw, "?Q600 %s", strings.Repeat("1", 10))
+		r.NoError(err)
+		buf, err := io.ReadAll(raw)
+		r.NoError(err)
+		r.Equal(">?, MDCMUX LINE TOO LONG\r\n>", string(buf))
+	})
+
+	t.Run("client_limit", func(t *testing.T) {
+		r := require.New(t)
+		_ = dialProxy(t, pConn.Addr())
+
+		raw, err := net.Dial("tcp", pConn.Addr())
+		r.NoError(err)
+		defer func() { _ = raw.Close() }()
+		buf, err := io.ReadAll(raw)
+		r.NoError(err)
+		r.Equal(">?, MDCMUX TOO MANY SESSIONS FROM CLIENT\r\n", string(buf))
+	})
+}
+
+// BenchmarkIdleSessions measures the proxy's CPU use while servicing many
+// idle client sessions. Each iteration performs a round-trip on an active
+// connection and reports the CPU time consumed per operation.
+func BenchmarkIdleSessions(b *testing.B) {
+	for _, count := range []int{0, 100, 500} {
+		b.Run(fmt.Sprintf("idle=%d", count), func(b *testing.B) {
+			r := require.New(b)
+
+			ctx := mdctest.NewStopperForTest(b)
+
+			d, err := dummy.New(ctx, "127.0.0.1:0")
+			r.NoError(err)
+
+			cfg := notify.VarOf(&Config{
+				Bind: netip.AddrFrom4([4]byte{127, 0, 0, 1}),
+				Targets: map[string]*Target{
+					d.Addr().String(): {},
+				},
+			})
+			_, pConn := startProxy(b, ctx, cfg)
+
+			for range count {
+				_ = dialProxy(b, pConn.Addr())
+			}
+
+			// The CPU metrics are only updated by a collection cycle.
+			samples := []metrics.Sample{
+				{Name: "/cpu/classes/total:cpu-seconds"},
+				{Name: "/cpu/classes/idle:cpu-seconds"},
+			}
+			cpu := func() float64 {
+				runtime.GC()
+				metrics.Read(samples)
+				return samples[0].Value.Float64() - samples[1].Value.Float64()
+			}
+
+			b.ResetTimer()
+			start := cpu()
+			for b.Loop() {
+				_, err := pConn.RoundTrip(ctx, message.CommandMachineModel)
+				r.NoError(err)
+				// Give idle sessions an opportunity to wake up.
+				time.Sleep(time.Millisecond)
+			}
+			b.ReportMetric((cpu()-start)*1e9/float64(b.N), "cpu-ns/op")
+		})
+	}
+}
+
+// dialProxy opens a raw connection to the proxy and consumes the greeting.
+func dialProxy(t testing.TB, addr string) net.Conn {
+	r := require.New(t)
+	raw, err := net.Dial("tcp", addr)
+	r.NoError(err)
+	t.Cleanup(func() { _ = raw.Close() })
+
+	buf := make([]byte, 1)
+	_, err = io.ReadFull(raw, buf)
+	r.NoError(err)
+	r.Equal(byte(message.Prompt), buf[0])
+	return raw
+}
+
+// A testSession is a raw connection to the proxy which exchanges lines.
+type testSession struct {
+	net.Conn
+	in *bufio.Scanner
+	t  testing.TB
+}
+
+// dialSession opens a raw connection to the proxy and consumes the greeting.
+func dialSession(t testing.TB, addr string) *testSession {
+	raw := dialProxy(t, addr)
+	in := bufio.NewScanner(raw)
+	in.Split(message.ScanPrompt)
+	return &testSession{Conn: raw, in: in, t: t}
+}
+
+// send writes a line to the proxy and returns its reply.
+func (s *testSession) send(line string) string {
+	s.write(line)
+	reply, ok := s.reply()
+	require.True(s.t, ok, "no reply to %q", line)
+	return reply
+}
+
+// write sends a line to the proxy without waiting for a reply.
+func (s *testSession) write(line string) {
+	_, err := io.WriteString(s, line+"\r\n")
+	require.NoError(s.t, err)
+}
+
+// reply reads the next reply from the proxy. It returns false if the proxy
+// has closed the connection.
+func (s *testSession) reply() (string, bool) {
+	if !s.in.Scan() {
+		return "", false
+	}
+	return s.in.Text(), true
+}
+
+// startProxy creates a proxy and waits for its first listener to be bound. It
+// returns a connection to that listener.
+func startProxy(t testing.TB, ctx *stopper.Context, cfg *notify.Var[*Config]) (*Proxy, *conn.Conn) {
+	r := require.New(t)
+
+	p, err := New(ctx, cfg)
+	r.NoError(err)
+
+	for {
+		p.mu.RLock()
+		_, reconfigured := p.reconfigured.Get()
+		bindings := p.mu.listeners
+		p.mu.RUnlock()
+
+		if len(bindings) == 0 {
+			select {
+			case <-ctx.Stopping():
+				r.Fail("never saw configuration update")
+			case <-reconfigured:
+				continue
+			}
+		}
+
+		r.Len(bindings, 1)
+		for _, b := range bindings {
+			pConn := conn.New(b.Addr().String())
+			t.Cleanup(pConn.Close)
+			return p, pConn
+		}
+	}
+}
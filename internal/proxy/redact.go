@@ -0,0 +1,101 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"slices"
+	"strings"
+
+	"vawter.tech/mdcmux/pkg/message"
+)
+
+// redact rewrites a response from the MDC host according to the policy's
+// redaction rules. The response is returned unchanged if no rule applies.
+func (p *Policy) redact(cmd message.Command, resp message.Response) message.Response {
+	n, ok := cmd.Command()
+	if !ok || cmd.IsWrite() {
+		return resp
+	}
+	masked := slices.ContainsFunc(p.RedactCommands, func(q QCommand) bool { return q.matches(n) })
+	if v, ok := cmd.Variable(); ok {
+		if _, hasValue := resp.Value(); hasValue &&
+			(masked || inRanges(p.RedactReads, int(v.Whole()))) {
+			return message.QueryResponse(message.NaN)
+		}
+		return resp
+	}
+	// Error replies from the MDC host are passed through.
+	fields := responseFields(resp)
+	if len(fields) < 2 || strings.HasPrefix(fields[0], "?") {
+		return resp
+	}
+	switch {
+	case masked:
+		return rewriteFields(resp, func(idx int, field string) string {
+			if idx == 0 {
+				return field
+			}
+			return maskField(field)
+		})
+	case p.RedactProgram && n == message.QThreeInOne && fields[0] == "PROGRAM":
+		return rewriteFields(resp, func(idx int, field string) string {
+			if idx == 1 {
+				return " "
+			}
+			return field
+		})
+	default:
+		return resp
+	}
+}
+
+// rewriteFields applies a function to each comma-separated field of an opaque
+// response. Any framing characters around the fields are retained.
+func rewriteFields(resp message.Response, fn func(idx int, field string) string) message.Response {
+	buf, ok := resp.Buffer()
+	if !ok {
+		return resp
+	}
+	s := string(buf)
+	body := strings.TrimLeft(s, "\x02")
+	prefix := s[:len(s)-len(body)]
+	trimmed := strings.TrimRight(body, "\x17\r\n ")
+	suffix := body[len(trimmed):]
+
+	fields := strings.Split(trimmed, ",")
+	for idx, field := range fields {
+		fields[idx] = fn(idx, field)
+	}
+	return message.OpaqueResponse([]byte(prefix+strings.Join(fields, ",")+suffix), resp.IsSuccess())
+}
+
+// maskField replaces the characters of a field, other than surrounding
+// whitespace, with asterisks.
+func maskField(field string) string {
+	trimmed := strings.TrimSpace(field)
+	if trimmed == "" {
+		return field
+	}
+	start := strings.Index(field, trimmed)
+	return field[:start] + strings.Repeat("*", len(trimmed)) + field[start+len(trimmed):]
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"vawter.tech/mdcmux/internal/mdctest"
+	"vawter.tech/mdcmux/pkg/dummy"
+	"vawter.tech/mdcmux/pkg/message"
+	"vawter.tech/notify"
+)
+
+func TestRedact(t *testing.T) {
+	policy := &Policy{
+		RedactCommands: []QCommand{100, 101},
+		RedactProgram:  true,
+		RedactReads:    [][2]int{{500, 599}},
+	}
+
+	tcs := []struct {
+		name     string
+		cmd      message.Command
+		resp     message.Response
+		expected string
+	}{
+		{
+			name:     "serial",
+			cmd:      message.CommandMachineSN,
+			resp:     message.OpaqueResponse([]byte("SERIAL NUMBER, 1024"), true),
+			expected: "SERIAL NUMBER, ****",
+		},
+		{
+			name:     "framed",
+			cmd:      message.CommandControlVersion,
+			resp:     message.OpaqueResponse([]byte("\x02SOFTWARE VERSION, 100.24\x17\r\n"), true),
+			expected: "\x02SOFTWARE VERSION, ******\x17\r\n",
+		},
+		{
+			name:     "program",
+			cmd:      message.CommandThreeInOne,
+			resp:     message.OpaqueResponse([]byte("PROGRAM, O01234, IDLE, PARTS, 3205"), true),
+			expected: "PROGRAM, , IDLE, PARTS, 3205",
+		},
+		{
+			name:     "busy",
+			cmd:      message.CommandThreeInOne,
+			resp:     message.OpaqueResponse([]byte("STATUS, BUSY"), true),
+			expected: "STATUS, BUSY",
+		},
+		{
+			name:     "macro",
+			cmd:      message.QueryCommand(message.Int(550)),
+			resp:     message.QueryResponse(message.Int(42)),
+			expected: "MACRO, NaN",
+		},
+		{
+			name:     "other macro",
+			cmd:      message.QueryCommand(message.Int(50)),
+			resp:     message.QueryResponse(message.Int(42)),
+			expected: "MACRO, 42.0",
+		},
+		{
+			name:     "error",
+			cmd:      message.CommandMachineSN,
+			resp:     message.OpaqueResponse([]byte("?, ?Q100"), false),
+			expected: "?, ?Q100",
+		},
+		{
+			name:     "unredacted",
+			cmd:      message.CommandMachineModel,
+			resp:     message.OpaqueResponse([]byte("MODEL, VF2"), true),
+			expected: "MODEL, VF2",
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			r := require.New(t)
+			r.Equal(tc.expected, policy.redact(tc.cmd, tc.resp).(fmt.Stringer).String())
+		})
+	}
+}
+
+func TestRedactProxied(t *testing.T) {
+	r := require.New(t)
+
+	ctx := mdctest.NewStopperForTest(t)
+
+	d, err := dummy.New(ctx, "127.0.0.1:0")
+	r.NoError(err)
+
+	cfg := notify.VarOf(&Config{
+		Bind: netip.AddrFrom4([4]byte{127, 0, 0, 1}),
+		Policy: map[netip.Prefix]*Policy{
+			netip.MustParsePrefix("127.0.0.1/32"): {
+				RedactCommands: []QCommand{QCommand(message.QMachineSN.Whole())},
+				RedactProgram:  true,
+			},
+		},
+		Targets: map[string]*Target{
+			d.Addr().String(): {},
+		},
+	})
+	_, pConn := startProxy(t, ctx, cfg)
+
+	resp, err := pConn.RoundTrip(ctx, message.CommandMachineSN)
+	r.NoError(err)
+	r.Equal("SERIAL NUMBER, ****", resp.(fmt.Stringer).String())
+
+	resp, err = pConn.RoundTrip(ctx, message.CommandThreeInOne)
+	r.NoError(err)
+	r.Equal("PROGRAM, , ALARM ON, PARTS, 3205", resp.(fmt.Stringer).String())
+}
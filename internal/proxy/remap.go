@@ -0,0 +1,75 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+
+	"vawter.tech/mdcmux/pkg/message"
+)
+
+// A Remap maps a range of macro variable numbers seen by a client onto the
+// variables of the MDC host.
+type Remap struct {
+	// To is the first variable on the MDC host.
+	To int `json:"to"`
+	// Variables is an inclusive range of macro variable numbers used by the
+	// client.
+	Variables [2]int `json:"variables"`
+}
+
+func (m *Remap) validate() error {
+	if m.Variables[0] > m.Variables[1] {
+		return fmt.Errorf("invalid variable range %v", m.Variables)
+	}
+	if m.To < 0 {
+		return errors.New("to must not be negative")
+	}
+	return nil
+}
+
+// remap returns a command which refers to the MDC host's variable numbers.
+// The first matching entry applies. Commands which do not refer to a
+// remapped variable are returned unchanged.
+func (p *Policy) remap(cmd message.Command) (message.Command, bool) {
+	v, ok := cmd.Variable()
+	if !ok || v.Frac() != 0 || len(p.Remap) == 0 {
+		return cmd, false
+	}
+	variable := int(v.Whole())
+	for _, m := range p.Remap {
+		if variable < m.Variables[0] || variable > m.Variables[1] {
+			continue
+		}
+		mapped := message.Int(m.To + variable - m.Variables[0])
+		if value, ok := cmd.Value(); ok && cmd.IsWrite() {
+			return message.WriteCommand(mapped, value), true
+		}
+		if n, ok := cmd.Command(); ok && n == message.QMacroVariable {
+			return message.QueryCommand(mapped), true
+		}
+		return cmd, false
+	}
+	return cmd, false
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"vawter.tech/mdcmux/internal/mdctest"
+	"vawter.tech/mdcmux/pkg/dummy"
+	"vawter.tech/mdcmux/pkg/message"
+	"vawter.tech/notify"
+)
+
+func TestRemap(t *testing.T) {
+	r := require.New(t)
+
+	ctx := mdctest.NewStopperForTest(t)
+
+	d, err := dummy.New(ctx, "127.0.0.1:0")
+	r.NoError(err)
+
+	cfg := notify.VarOf(&Config{
+		Bind: netip.AddrFrom4([4]byte{127, 0, 0, 1}),
+		Policy: map[netip.Prefix]*Policy{
+			netip.MustParsePrefix("127.0.0.1/32"): {
+				AllowReads:  [][2]int{{10200, 10299}},
+				AllowWrites: [][2]int{{10200, 10249}},
+				Remap: []*Remap{
+					{Variables: [2]int{100, 199}, To: 10200},
+				},
+			},
+		},
+		Targets: map[string]*Target{
+			d.Addr().String(): {},
+		},
+	})
+	_, pConn := startProxy(t, ctx, cfg)
+
+	send := dialSession(t, pConn.Addr()).send
+
+	r.Equal("!", send("?E105 1.5"))
+	found, ok := d.Peek(message.Int(10205))
+	r.True(ok)
+	r.Equal(message.NewNumber(1, 5), found)
+	r.Equal("MACRO, 1.5", send("?Q600 105"))
+
+	// Access checks apply to the MDC host's variables.
+	r.Equal("?, MDCMUX DENY POLICY", send("?E150 1"))
+	r.Equal("?, MDCMUX DENY POLICY", send("?Q600 5"))
+	r.Equal("MACRO, 1.5", send("?Q600 10205"))
+}
+
+func TestExplainRemap(t *testing.T) {
+	r := require.New(t)
+
+	cfg := &Config{
+		Policy: map[netip.Prefix]*Policy{
+			netip.MustParsePrefix("10.0.0.0/8"): {
+				AllowWrites: [][2]int{{10200, 10299}},
+				Remap:       []*Remap{{Variables: [2]int{100, 199}, To: 10200}},
+			},
+		},
+		Targets: map[string]*Target{"127.0.0.1:5051": {}},
+	}
+	r.NoError(cfg.Expand())
+
+	ex, err := cfg.Explain(context.Background(), "127.0.0.1:5051",
+		netip.MustParseAddr("10.1.1.1"), "", "?E101 1", time.Now())
+	r.NoError(err)
+	r.True(ex.Allowed, ex.Reason)
+	r.Equal(message.WriteCommand(message.Int(10201), message.Int(1)), ex.Remapped)
+
+	r.ErrorContains((&Config{Policy: map[netip.Prefix]*Policy{
+		netip.MustParsePrefix("10.0.0.0/8"): {Remap: []*Remap{{Variables: [2]int{2, 1}}}},
+	}}).Expand(), "remap 0: invalid variable range")
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"math"
+	"net/netip"
+	"strings"
+	"time"
+
+	"vawter.tech/mdcmux/internal/expr"
+	"vawter.tech/mdcmux/pkg/message"
+)
+
+// A Request is a command to be checked by a [Policy], along with the context
+// in which it was sent.
+type Request struct {
+	// Backend may be used to read the current state of the MDC host. It may
+	// be nil, in which case checks which require the state will fail.
+	Backend RoundTripper
+	Client  netip.Addr
+	Command message.Command
+	// Groups of the authenticated principal.
+	Groups []string
+	// Principal is the name of the authenticated principal, if any.
+	Principal string
+	// State may cache responses from the Backend. It is used to evaluate
+	// interlocks, which tolerate slightly stale readings, but not to read
+	// the current value of a variable. Backend is used if nil.
+	State RoundTripper
+	// Tags of the target.
+	Tags []string
+	// Target is the hostname of the MDC host.
+	Target string
+	Time   time.Time
+}
+
+// exprEnv declares the names available to policy expressions.
+var exprEnv = expr.Env{
+	"client":    expr.String,
+	"cmd.name":  expr.String,
+	"cmd.q":     expr.Number,
+	"cmd.read":  expr.Bool,
+	"cmd.write": expr.Bool,
+	"groups":    expr.StringList,
+	"hour":      expr.Number,
+	"minute":    expr.Number,
+	"principal": expr.String,
+	"tags":      expr.StringList,
+	"target":    expr.String,
+	"value":     expr.Number,
+	"var":       expr.Number,
+	"weekday":   expr.String,
+}
+
+// values returns the variables used to evaluate policy expressions. Numbers
+// which do not apply to the command are -1, except for value, which is NaN.
+func (r *Request) values() expr.Values {
+	cmd := r.Command
+	q, variable, value := -1.0, -1.0, math.NaN()
+	name := ""
+	if n, ok := cmd.Command(); ok {
+		q = n.Float64()
+		name, _ = message.CommandName(n)
+	}
+	if n, ok := cmd.Variable(); ok {
+		variable = n.Float64()
+	}
+	if n, ok := cmd.Value(); ok && cmd.IsWrite() {
+		value = n.Float64()
+	}
+	client := ""
+	if r.Client.IsValid() {
+		client = r.Client.String()
+	}
+	groups := r.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+	tags := r.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return expr.Values{
+		"client":    client,
+		"cmd.name":  name,
+		"cmd.q":     q,
+		"cmd.read":  !cmd.IsWrite() && variable >= 0,
+		"cmd.write": cmd.IsWrite(),
+		"groups":    groups,
+		"hour":      float64(r.Time.Hour()),
+		"minute":    float64(r.Time.Minute()),
+		"principal": r.Principal,
+		"tags":      tags,
+		"target":    r.Target,
+		"value":     value,
+		"var":       variable,
+		"weekday":   strings.ToLower(r.Time.Weekday().String()[:3]),
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"vawter.tech/mdcmux/pkg/message"
+)
+
+// Reasons reported when a write is denied by a WriteRule.
+const (
+	denyAboveMax       = "value above maximum"
+	denyBelowMin       = "value below minimum"
+	denyChange         = "value change too large"
+	denyNotInteger     = "value not an integer"
+	denyNotInValues    = "value not in allowed values"
+	denyNotANumber     = "value is not a number"
+	denyNoCurrentValue = "could not read current value"
+)
+
+// Reasons reported when a write is denied by an Interlock.
+const (
+	denyInterlockMacro   = "interlock: macro variable"
+	denyInterlockMode    = "interlock: machine mode"
+	denyInterlockProgram = "interlock: program"
+	denyInterlockStatus  = "interlock: machine status"
+	denyNoMachineState   = "could not read machine state"
+)
+
+// A RoundTripper sends a command to an MDC host. It is implemented by
+// [conn.Conn].
+type RoundTripper interface {
+	RoundTrip(ctx context.Context, cmd message.Command) (message.Response, error)
+}
+
+// A WriteRule constrains the values which may be written to a range of macro
+// variables. A rule does not grant write access by itself; the variables must
+// also be listed in the policy's AllowWrites.
+type WriteRule struct {
+	// IntegerOnly rejects values with a fractional part.
+	IntegerOnly bool `json:"integer_only"`
+	// Max is the largest value which may be written.
+	Max *float64 `json:"max"`
+	// MaxChange limits the difference between the written value and the
+	// variable's current value. The current value is read from the MDC host
+	// before the write is sent. Zero is unlimited.
+	MaxChange float64 `json:"max_change"`
+	// Min is the smallest value which may be written.
+	Min *float64 `json:"min"`
+	// Values is an exhaustive list of values which may be written.
+	Values []float64 `json:"values"`
+	// Variables is an inclusive pair of macro variable numbers to which the
+	// rule applies.
+	Variables [2]int `json:"variables"`
+}
+
+// check returns a denial reason if the value may not be written to the
+// variable. The backend is used to read the current value only if the rule
+// sets MaxChange. A failure to read the current value denies the write.
+func (r *WriteRule) check(
+	ctx context.Context, variable int, value message.Number, backend RoundTripper,
+) string {
+	if variable < r.Variables[0] || variable > r.Variables[1] {
+		return ""
+	}
+	// NaN passes the integer check and defeats the comparisons below.
+	if value.IsNaN() {
+		return denyNotANumber
+	}
+	f := value.Float64()
+	switch {
+	case r.IntegerOnly && value.Frac() != 0:
+		return denyNotInteger
+	case r.Min != nil && !(f >= *r.Min):
+		return denyBelowMin
+	case r.Max != nil && !(f <= *r.Max):
+		return denyAboveMax
+	case len(r.Values) > 0 && !containsFloat(r.Values, f):
+		return denyNotInValues
+	}
+
+	if r.MaxChange > 0 {
+		if backend == nil {
+			return denyNoCurrentValue
+		}
+		resp, err := backend.RoundTrip(ctx, message.QueryCommand(message.Int(variable)))
+		if err != nil {
+			return denyNoCurrentValue
+		}
+		current, ok := resp.Value()
+		if !ok || current.IsNaN() {
+			return denyNoCurrentValue
+		}
+		if !(math.Abs(f-current.Float64()) <= r.MaxChange) {
+			return denyChange
+		}
+	}
+	return ""
+}
+
+// validate returns an error if the rule cannot be satisfied.
+func (r *WriteRule) validate() error {
+	if r.Variables[0] > r.Variables[1] {
+		return fmt.Errorf("invalid variable range %v", r.Variables)
+	}
+	if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+		return errors.New("min is greater than max")
+	}
+	if r.MaxChange < 0 {
+		return errors.New("max_change must not be negative")
+	}
+	return nil
+}
+
+func containsFloat(values []float64, f float64) bool {
+	for _, v := range values {
+		if v == f {
+			return true
+		}
+	}
+	return false
+}
+
+// An Interlock makes writes to a range of macro variables conditional on the
+// live state of the machine. All conditions which are set must be satisfied.
+// Machine names are compared case-insensitively.
+type Interlock struct {
+	// Macro requires a macro variable to have a specific value.
+	Macro *MacroCondition `json:"macro"`
+	// Mode lists the Q104 modes in which writes are allowed.
+	Mode []string `json:"mode"`
+	// NotMode lists the Q104 modes in which writes are denied.
+	NotMode []string `json:"not_mode"`
+	// NotStatus lists the Q500 statuses in which writes are denied.
+	NotStatus []string `json:"not_status"`
+	// Program lists the Q500 program names for which writes are allowed.
+	Program []string `json:"program"`
+	// Status lists the Q500 statuses, such as "IDLE", in which writes are
+	// allowed.
+	Status []string `json:"status"`
+	// Variables is an inclusive pair of macro variable numbers to which the
+	// interlock applies.
+	Variables [2]int `json:"variables"`
+}
+
+// A MacroCondition requires a macro variable to have a specific value.
+type MacroCondition struct {
+	Equals   float64 `json:"equals"`
+	Variable int     `json:"variable"`
+}
+
+// check returns a denial reason if the machine is not in a state which
+// permits writing to the variable. A failure to read the machine's state
+// denies the write.
+func (i *Interlock) check(ctx context.Context, variable int, backend RoundTripper) string {
+	if variable < i.Variables[0] || variable > i.Variables[1] {
+		return ""
+	}
+	if backend == nil {
+		return denyNoMachineState
+	}
+
+	if len(i.Mode) > 0 || len(i.NotMode) > 0 {
+		mode, err := readMode(ctx, backend)
+		if err != nil {
+			return denyNoMachineState
+		}
+		if !allowName(i.Mode, i.NotMode, mode) {
+			return denyInterlockMode
+		}
+	}
+
+	if len(i.Program) > 0 || len(i.Status) > 0 || len(i.NotStatus) > 0 {
+		program, status, err := readStatus(ctx, backend)
+		if err != nil {
+			return denyNoMachineState
+		}
+		if !allowName(i.Status, i.NotStatus, status) {
+			return denyInterlockStatus
+		}
+		if !allowName(i.Program, nil, program) {
+			return denyInterlockProgram
+		}
+	}
+
+	if m := i.Macro; m != nil {
+		resp, err := backend.RoundTrip(ctx, message.QueryCommand(message.Int(m.Variable)))
+		if err != nil {
+			return denyNoMachineState
+		}
+		value, ok := resp.Value()
+		if !ok || value.IsNaN() {
+			return denyNoMachineState
+		}
+		if value.Float64() != m.Equals {
+			return denyInterlockMacro
+		}
+	}
+	return ""
+}
+
+// validate returns an error if the interlock cannot be used.
+func (i *Interlock) validate() error {
+	if i.Variables[0] > i.Variables[1] {
+		return fmt.Errorf("invalid variable range %v", i.Variables)
+	}
+	if m := i.Macro; m != nil && m.Variable <= 0 {
+		return errors.New("macro condition requires a variable number")
+	}
+	return nil
+}
+
+// allowName returns true if the name is not denied and is allowed by a
+// non-empty allow list.
+func allowName(allow, deny []string, name string) bool {
+	equal := func(s string) bool { return strings.EqualFold(s, name) }
+	if slices.ContainsFunc(deny, equal) {
+		return false
+	}
+	return len(allow) == 0 || slices.ContainsFunc(allow, equal)
+}
@@ -0,0 +1,244 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"vawter.tech/mdcmux/internal/mdctest"
+	"vawter.tech/mdcmux/pkg/dummy"
+	"vawter.tech/mdcmux/pkg/message"
+	"vawter.tech/notify"
+)
+
+// roundTripFunc implements RoundTripper for testing.
+type roundTripFunc func(ctx context.Context, cmd message.Command) (message.Response, error)
+
+func (f roundTripFunc) RoundTrip(ctx context.Context, cmd message.Command) (message.Response, error) {
+	return f(ctx, cmd)
+}
+
+func TestWriteRules(t *testing.T) {
+	minimum, maximum := -1.5, 100.0
+	policy := &Policy{
+		AllowWrites: [][2]int{{1, 100}},
+		WriteRules: []*WriteRule{
+			{Variables: [2]int{1, 10}, Min: &minimum, Max: &maximum},
+			{Variables: [2]int{5, 5}, IntegerOnly: true},
+			{Variables: [2]int{20, 20}, Values: []float64{0, 1, 2.5}},
+			{Variables: [2]int{30, 30}, MaxChange: 10},
+			{Variables: [2]int{40, 40}, IntegerOnly: true},
+		},
+	}
+
+	current := message.Int(50)
+	backend := roundTripFunc(func(_ context.Context, cmd message.Command) (message.Response, error) {
+		if v, _ := cmd.Variable(); v != message.Int(30) {
+			return nil, errors.New("unexpected read")
+		}
+		return message.QueryResponse(current), nil
+	})
+	broken := roundTripFunc(func(context.Context, message.Command) (message.Response, error) {
+		return nil, errors.New("unavailable")
+	})
+
+	tcs := []struct {
+		variable int
+		value    message.Number
+		backend  RoundTripper
+		reason   string
+	}{
+		{1, message.Int(100), nil, ""},
+		{1, message.NewNumber(-1, 5), nil, ""},
+		{1, message.Int(-2), nil, denyBelowMin},
+		{1, message.NewNumber(100, 1), nil, denyAboveMax},
+		{1, message.Int(1000000000000), nil, denyAboveMax},
+		{5, message.Int(7), nil, ""},
+		{5, message.NewNumber(7, 5), nil, denyNotInteger},
+		{20, message.NewNumber(2, 5), nil, ""},
+		{20, message.Int(2), nil, denyNotInValues},
+		{30, message.Int(60), backend, ""},
+		{30, message.Int(40), backend, ""},
+		{30, message.NewNumber(60, 1), backend, denyChange},
+		{30, message.Int(60), broken, denyNoCurrentValue},
+		{30, message.Int(60), nil, denyNoCurrentValue},
+		{40, message.Int(3), nil, ""},
+		{40, message.NaN, nil, denyNotANumber},
+		{1, message.NaN, nil, denyNotANumber},
+		// Rules don't grant access.
+		{101, message.Int(1), nil, denyWrite},
+	}
+
+	for idx, tc := range tcs {
+		t.Run(strconv.Itoa(idx), func(t *testing.T) {
+			r := require.New(t)
+			cmd := message.WriteCommand(message.Int(tc.variable), tc.value)
+			ok, reason := policy.Allow(t.Context(), &Request{Backend: tc.backend, Command: cmd})
+			r.Equal(tc.reason == "", ok)
+			r.Equal(tc.reason, reason)
+		})
+	}
+}
+
+func TestInvalidWriteRules(t *testing.T) {
+	r := require.New(t)
+
+	minimum, maximum := 10.0, 1.0
+	cfg := &Config{
+		Targets: map[string]*Target{
+			"example:5051": {
+				IdentityPolicy: map[string]*Policy{
+					"alice": {WriteRules: []*WriteRule{{Min: &minimum, Max: &maximum}}},
+				},
+			},
+		},
+	}
+	r.ErrorContains(cfg.Expand(), "identity policy alice: write rule 0: min is greater than max")
+}
+
+func TestInterlocks(t *testing.T) {
+	policy := &Policy{
+		AllowWrites: [][2]int{{1, 100}},
+		Interlocks: []*Interlock{
+			{Variables: [2]int{1, 10}, NotMode: []string{"mem"}},
+			{Variables: [2]int{11, 20}, Status: []string{"IDLE"}, Program: []string{"O01234"}},
+			{Variables: [2]int{21, 30}, Macro: &MacroCondition{Variable: 99, Equals: 1}},
+		},
+	}
+
+	var mode, status string
+	var macro message.Number
+	reads := 0
+	backend := newMachineState(roundTripFunc(
+		func(_ context.Context, cmd message.Command) (message.Response, error) {
+			reads++
+			switch cmd {
+			case message.CommandMode:
+				return message.OpaqueResponse([]byte(mode), true), nil
+			case message.CommandThreeInOne:
+				return message.OpaqueResponse([]byte(status), true), nil
+			}
+			if v, _ := cmd.Variable(); v == message.Int(99) {
+				return message.QueryResponse(macro), nil
+			}
+			return nil, errors.New("unexpected command")
+		}))
+	backend.setTTL(time.Hour)
+
+	tcs := []struct {
+		variable int
+		mode     string
+		status   string
+		macro    message.Number
+		reason   string
+	}{
+		{variable: 1, mode: "MODE, MDI"},
+		{variable: 1, mode: "MODE, (MEM)", reason: denyInterlockMode},
+		{variable: 1, mode: "\x02MODE, MEM\x17", reason: denyInterlockMode},
+		{variable: 1, mode: "garbage", reason: denyNoMachineState},
+		{variable: 11, status: "PROGRAM, O01234, IDLE, PARTS, 3205"},
+		{variable: 11, status: "PROGRAM, O01234, ALARM ON, PARTS, 3205", reason: denyInterlockStatus},
+		{variable: 11, status: "PROGRAM, O09999, IDLE, PARTS, 3205", reason: denyInterlockProgram},
+		{variable: 11, status: "STATUS, BUSY", reason: denyInterlockStatus},
+		{variable: 21, macro: message.Int(1)},
+		{variable: 21, macro: message.Int(0), reason: denyInterlockMacro},
+		{variable: 21, macro: message.NaN, reason: denyNoMachineState},
+		// No interlock applies.
+		{variable: 50},
+	}
+
+	for idx, tc := range tcs {
+		t.Run(strconv.Itoa(idx), func(t *testing.T) {
+			r := require.New(t)
+			mode, status, macro = tc.mode, tc.status, tc.macro
+			backend.reset()
+
+			cmd := message.WriteCommand(message.Int(tc.variable), message.Int(1))
+			ok, reason := policy.Allow(t.Context(), &Request{Backend: backend, Command: cmd})
+			r.Equal(tc.reason == "", ok)
+			r.Equal(tc.reason, reason)
+		})
+	}
+
+	t.Run("cached", func(t *testing.T) {
+		r := require.New(t)
+		mode = "MODE, MDI"
+		backend.reset()
+		reads = 0
+
+		cmd := message.WriteCommand(message.Int(1), message.Int(1))
+		for range 3 {
+			ok, _ := policy.Allow(t.Context(), &Request{Backend: backend, Command: cmd})
+			r.True(ok)
+		}
+		r.Equal(1, reads)
+
+		// The cache is read-only.
+		_, err := backend.RoundTrip(t.Context(), cmd)
+		r.Error(err)
+	})
+}
+
+func TestWriteRuleCurrentValue(t *testing.T) {
+	r := require.New(t)
+
+	ctx := mdctest.NewStopperForTest(t)
+
+	d, err := dummy.New(ctx, "127.0.0.1:0")
+	r.NoError(err)
+	d.Poke(message.Int(5), message.Int(0))
+
+	cfg := notify.VarOf(&Config{
+		Bind:           netip.AddrFrom4([4]byte{127, 0, 0, 1}),
+		InterlockCache: time.Hour,
+		Policy: map[netip.Prefix]*Policy{
+			netip.MustParsePrefix("127.0.0.1/32"): {
+				AllowWrites: [][2]int{{1, 10}},
+				Interlocks:  []*Interlock{{Variables: [2]int{1, 10}, NotMode: []string{"MEM"}}},
+				WriteRules:  []*WriteRule{{Variables: [2]int{1, 10}, MaxChange: 5}},
+			},
+		},
+		Targets: map[string]*Target{
+			d.Addr().String(): {},
+		},
+	})
+	_, pConn := startProxy(t, ctx, cfg)
+
+	send := dialSession(t, pConn.Addr()).send
+	// A denied write populates the interlock cache without resetting it.
+	r.Equal("?, MDCMUX DENY POLICY", send("?E5 100"))
+
+	// A change made outside of the proxy is seen by the next write.
+	d.Poke(message.Int(5), message.Int(50))
+	r.Equal("?, MDCMUX DENY POLICY", send("?E5 3"))
+	r.Equal("!", send("?E5 53"))
+	found, ok := d.Peek(message.Int(5))
+	r.True(ok)
+	r.Equal(message.Int(53), found)
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	// The container image has no zoneinfo database.
+	_ "time/tzdata"
+)
+
+// minutesPerDay is the end of the last possible window.
+const minutesPerDay = 24 * 60
+
+// A Schedule defines the times at which a policy applies.
+type Schedule struct {
+	// Days lists the days of the week, such as "mon", on which windows
+	// start. Every day is included if empty.
+	Days []string `json:"days"`
+	// TimeZone is an IANA time zone name. The proxy's local time zone is used
+	// if empty.
+	TimeZone string `json:"time_zone"`
+	// Windows are the times of day at which the policy applies. The whole
+	// day is included if empty.
+	Windows []*Window `json:"windows"`
+
+	days     [7]bool
+	location *time.Location
+}
+
+// A Window is a time range, such as 15:00 to 23:30. The window crosses
+// midnight if the end is before the start, in which case it belongs to the
+// day on which it starts.
+type Window struct {
+	End   string `json:"end"`
+	Start string `json:"start"`
+
+	end, start int // Minutes since midnight.
+}
+
+// Active returns true if the schedule includes the given time.
+func (s *Schedule) Active(now time.Time) bool {
+	now = now.In(s.location)
+	day := now.Weekday()
+	yesterday := (day + 6) % 7
+	minute := now.Hour()*60 + now.Minute()
+
+	if len(s.Windows) == 0 {
+		return s.days[day]
+	}
+	for _, w := range s.Windows {
+		if w.start < w.end {
+			if s.days[day] && w.start <= minute && minute < w.end {
+				return true
+			}
+			continue
+		}
+		// The window crosses midnight.
+		if s.days[day] && minute >= w.start || s.days[yesterday] && minute < w.end {
+			return true
+		}
+	}
+	return false
+}
+
+// expand validates the schedule and computes derived data.
+func (s *Schedule) expand() error {
+	s.location = time.Local
+	if s.TimeZone != "" {
+		loc, err := time.LoadLocation(s.TimeZone)
+		if err != nil {
+			return fmt.Errorf("invalid time zone: %w", err)
+		}
+		s.location = loc
+	}
+
+	s.days = [7]bool{}
+	for _, day := range s.Days {
+		idx := slices.IndexFunc(dayNames[:], func(name string) bool {
+			return strings.EqualFold(name, day)
+		})
+		if idx < 0 {
+			return fmt.Errorf("invalid day %q", day)
+		}
+		s.days[idx] = true
+	}
+	if len(s.Days) == 0 {
+		s.days = [7]bool{true, true, true, true, true, true, true}
+	}
+
+	for idx, w := range s.Windows {
+		var err error
+		if w.start, err = parseTimeOfDay(w.Start); err != nil {
+			return fmt.Errorf("window %d: start: %w", idx, err)
+		}
+		if w.end, err = parseTimeOfDay(w.End); err != nil {
+			return fmt.Errorf("window %d: end: %w", idx, err)
+		}
+		if w.start == w.end {
+			return fmt.Errorf("window %d: empty window", idx)
+		}
+	}
+	return nil
+}
+
+var dayNames = [7]string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseTimeOfDay converts an HH:MM time into minutes since midnight. The
+// time 24:00 is accepted as the end of the day.
+func parseTimeOfDay(s string) (int, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 || len(s) != 5 {
+		return 0, fmt.Errorf("expected HH:MM, found %q", s)
+	}
+	ret := h*60 + m
+	if h < 0 || m < 0 || m >= 60 || ret > minutesPerDay {
+		return 0, errors.New("time out of range")
+	}
+	return ret, nil
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduleActive(t *testing.T) {
+	r := require.New(t)
+
+	chicago, err := time.LoadLocation("America/Chicago")
+	r.NoError(err)
+	// 2025-01-06 is a Monday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2025, 1, 6+day, hour, minute, 0, 0, chicago)
+	}
+
+	shift := &Schedule{
+		Days:     []string{"mon", "Tue"},
+		TimeZone: "America/Chicago",
+		Windows:  []*Window{{Start: "15:00", End: "23:30"}},
+	}
+	overnight := &Schedule{
+		Days:     []string{"fri"},
+		TimeZone: "America/Chicago",
+		Windows:  []*Window{{Start: "22:00", End: "06:00"}},
+	}
+	weekend := &Schedule{
+		Days:     []string{"sat", "sun"},
+		TimeZone: "America/Chicago",
+	}
+	for _, s := range []*Schedule{shift, overnight, weekend} {
+		r.NoError(s.expand())
+	}
+
+	tcs := []struct {
+		schedule *Schedule
+		now      time.Time
+		active   bool
+	}{
+		{shift, at(0, 15, 0), true},
+		{shift, at(0, 23, 29), true},
+		{shift, at(0, 23, 30), false},
+		{shift, at(0, 14, 59), false},
+		{shift, at(1, 16, 0), true},
+		{shift, at(2, 16, 0), false},
+		// The same instant, expressed in another zone.
+		{shift, at(0, 16, 0).UTC(), true},
+		{overnight, at(4, 21, 59), false},
+		{overnight, at(4, 22, 0), true},
+		{overnight, at(5, 5, 59), true},
+		{overnight, at(5, 6, 0), false},
+		{overnight, at(5, 23, 0), false},
+		{weekend, at(5, 0, 0), true},
+		{weekend, at(6, 23, 59), true},
+		{weekend, at(7, 0, 0), false},
+	}
+	for _, tc := range tcs {
+		r.Equal(tc.active, tc.schedule.Active(tc.now), "%s", tc.now)
+	}
+}
+
+func TestInvalidSchedule(t *testing.T) {
+	tcs := []struct {
+		schedule *Schedule
+		err      string
+	}{
+		{&Schedule{TimeZone: "Mars/Olympus_Mons"}, "invalid time zone"},
+		{&Schedule{Days: []string{"monday"}}, `invalid day "monday"`},
+		{&Schedule{Windows: []*Window{{Start: "9:00", End: "17:00"}}}, "window 0: start: expected HH:MM"},
+		{&Schedule{Windows: []*Window{{Start: "09:00", End: "24:01"}}}, "window 0: end: time out of range"},
+		{&Schedule{Windows: []*Window{{Start: "09:00", End: "09:00"}}}, "window 0: empty window"},
+	}
+	for _, tc := range tcs {
+		require.ErrorContains(t, tc.schedule.expand(), tc.err)
+	}
+
+	cfg := &Config{
+		Policy: map[netip.Prefix]*Policy{
+			netip.MustParsePrefix("10.0.0.0/8"): {Schedule: "missing"},
+		},
+	}
+	require.ErrorContains(t, cfg.Expand(), `unknown schedule "missing"`)
+}
+
+// A policy outside of its schedule is skipped, so that a less-specific
+// policy applies.
+func TestScheduledPolicy(t *testing.T) {
+	r := require.New(t)
+
+	cfg := &Config{
+		IdentityPolicy: map[string]*Policy{
+			"lead": {AllowWrites: [][2]int{{3901, 3902}}, Schedule: "second_shift"},
+		},
+		Policy: map[netip.Prefix]*Policy{
+			netip.MustParsePrefix("10.0.0.0/8"): {},
+		},
+		Principals: map[string]*Principal{"lead": {}},
+		Schedules: map[string]*Schedule{
+			"second_shift": {
+				TimeZone: "UTC",
+				Windows:  []*Window{{Start: "15:00", End: "23:30"}},
+			},
+		},
+		Targets: map[string]*Target{"example:5051": {}},
+	}
+	r.NoError(cfg.Expand())
+
+	tgt := cfg.Targets["example:5051"]
+	source := netip.MustParseAddr("10.1.1.1")
+	who, ok := cfg.principal("lead", source)
+	r.True(ok)
+
+	found, ok := tgt.PolicyFor(source, who, time.Date(2025, 1, 6, 16, 0, 0, 0, time.UTC))
+	r.True(ok)
+	r.Same(cfg.IdentityPolicy["lead"], found)
+
+	found, ok = tgt.PolicyFor(source, who, time.Date(2025, 1, 6, 8, 0, 0, 0, time.UTC))
+	r.True(ok)
+	r.Same(cfg.Policy[netip.MustParsePrefix("10.0.0.0/8")], found)
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"vawter.tech/stopper"
+)
+
+// Reasons for a session to be interrupted.
+var (
+	errExpired   = errors.New("session expired")
+	errIdle      = errors.New("idle timeout")
+	errNoCommand = errors.New(rejectNoCommand)
+	errStopping  = errors.New("proxy stopping")
+)
+
+// A session tracks the lifecycle of a single client connection. Client reads
+// block normally; timers and the stopper's stopping channel interrupt a
+// blocked read by moving the read deadline into the past.
+type session struct {
+	client   netip.Addr
+	conn     net.Conn
+	creds    *credentials // May be updated by the XAUTH command.
+	done     chan struct{}
+	failed   bool // Set once a failure has been counted towards a ban.
+	first    *time.Timer
+	id       string // Identifies the session in logs and the write journal.
+	idle     *time.Timer
+	lifetime *time.Timer
+	start    time.Time
+	logger   *slog.Logger
+	out      *bufio.Writer
+	proxied  bool // Set once a command has been sent to the MDC host.
+	routed   bool // Set once the session has been routed to a policy.
+	router   func() (*binding, bool)
+	unrouted func(context.Context, []byte) // Evaluates shadow policies.
+	writes   writeThrottle
+
+	mu struct {
+		sync.Mutex
+		busy   bool // Set while a message is being processed.
+		reason error
+	}
+}
+
+// newSession starts the background behaviors associated with the client
+// connection. The session must be closed by the caller.
+func newSession(
+	ctx *stopper.Context, conn net.Conn, firstCommand, maxIdle time.Duration,
+) *session {
+	s := &session{
+		conn:  conn,
+		done:  make(chan struct{}),
+		id:    randomID(),
+		start: time.Now(),
+	}
+	s.first = time.AfterFunc(firstCommand, func() { s.interrupt(errNoCommand) })
+	s.idle = time.AfterFunc(maxIdle, func() { s.interrupt(errIdle) })
+	s.lifetime = time.AfterFunc(time.Hour, func() { s.interrupt(errExpired) })
+	s.lifetime.Stop()
+
+	// Interrupt the session if the proxy is being shut down.
+	if !ctx.Go(func(ctx *stopper.Context) error {
+		select {
+		case <-ctx.Stopping():
+			s.interrupt(errStopping)
+		case <-s.done:
+		}
+		return nil
+	}) {
+		s.interrupt(errStopping)
+	}
+	return s
+}
+
+// randomID returns a short, random identifier.
+func randomID() string {
+	buf := make([]byte, 4)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// busy suspends the idle timer while a message is being processed. If the
+// idle timer fired as the message arrived, the interruption is withdrawn.
+func (s *session) busy() {
+	s.idle.Stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mu.busy = true
+	if s.mu.reason == errIdle {
+		s.mu.reason = nil
+		_ = s.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// commanded satisfies the first-command timeout once a command has been
+// received. Empty lines do not count as commands.
+func (s *session) commanded() {
+	s.first.Stop()
+}
+
+// close releases the resources associated with the session. It does not
+// close the underlying connection.
+func (s *session) close() {
+	s.first.Stop()
+	s.idle.Stop()
+	s.lifetime.Stop()
+	close(s.done)
+}
+
+// interrupt records the reason for ending the session and unblocks any
+// pending read. Only the first reason is retained, except that an idle
+// timeout may be replaced, since it is withdrawn if a message arrives. An
+// idle timeout is ignored while a message is being processed.
+func (s *session) interrupt(reason error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if reason == errIdle && s.mu.busy {
+		return
+	}
+	if s.mu.reason == nil || s.mu.reason == errIdle {
+		s.mu.reason = reason
+	}
+	_ = s.conn.SetReadDeadline(time.Unix(1, 0))
+}
+
+// interrupted returns a non-nil reason if the session has been interrupted.
+func (s *session) interrupted() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mu.reason
+}
+
+// ready restarts the idle timer once the session is waiting for the next
+// client message. The session lifetime is re-evaluated, since the policy
+// applied to the session may have changed.
+func (s *session) ready(policy *Policy) {
+	s.mu.Lock()
+	s.mu.busy = false
+	s.mu.Unlock()
+
+	s.idle.Reset(policy.MaxIdle)
+	if policy.MaxSession > 0 {
+		s.lifetime.Reset(time.Until(s.start.Add(policy.MaxSession)))
+	} else {
+		s.lifetime.Stop()
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"vawter.tech/mdcmux/internal/mdctest"
+)
+
+func TestSessionIdleRace(t *testing.T) {
+	r := require.New(t)
+
+	ctx := mdctest.NewStopperForTest(t)
+	client, server := net.Pipe()
+	t.Cleanup(func() { _ = client.Close() })
+	t.Cleanup(func() { _ = server.Close() })
+
+	sess := newSession(ctx, server, time.Hour, time.Nanosecond)
+	t.Cleanup(sess.close)
+
+	// The idle timer fires just as a line arrives.
+	r.Eventually(func() bool { return sess.interrupted() != nil }, time.Second, time.Millisecond)
+	sess.busy()
+	r.NoError(sess.interrupted())
+
+	// The session remains readable.
+	go func() { _, _ = io.WriteString(client, "?Q100\r\n") }()
+	buf := make([]byte, 7)
+	_, err := io.ReadFull(server, buf)
+	r.NoError(err)
+	r.Equal("?Q100\r\n", string(buf))
+
+	// The idle timer is ignored while the message is being processed.
+	sess.idle.Reset(time.Nanosecond)
+	time.Sleep(10 * time.Millisecond)
+	r.NoError(sess.interrupted())
+
+	// Other reasons are not withdrawn.
+	sess.interrupt(errStopping)
+	sess.busy()
+	r.ErrorIs(sess.interrupted(), errStopping)
+}
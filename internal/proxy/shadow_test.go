@@ -0,0 +1,243 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"vawter.tech/mdcmux/internal/mdctest"
+	"vawter.tech/mdcmux/pkg/dummy"
+	"vawter.tech/mdcmux/pkg/message"
+	"vawter.tech/notify"
+)
+
+func TestShadowPolicy(t *testing.T) {
+	r := require.New(t)
+
+	cfg := &Config{
+		Policy: map[netip.Prefix]*Policy{
+			netip.MustParsePrefix("10.0.0.0/8"): {AllowWrites: [][2]int{{1, 100}}},
+		},
+		ShadowPolicy: &ShadowPolicy{
+			Policy: map[netip.Prefix]*Policy{
+				netip.MustParsePrefix("10.0.0.0/8"): {AllowWrites: [][2]int{{1, 10}}},
+			},
+		},
+		Targets: map[string]*Target{
+			"umc750": {},
+			"vf2": {
+				// Replaces the global shadow policy for this target.
+				ShadowPolicy: &ShadowPolicy{
+					Deny: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+					Policy: map[netip.Prefix]*Policy{
+						netip.MustParsePrefix("10.1.0.0/16"): {
+							AllowReads:         [][2]int{{1, 10}},
+							AllowUndocumentedQ: true,
+							Inherit:            true,
+						},
+					},
+				},
+			},
+		},
+	}
+	r.NoError(cfg.Expand())
+
+	client := netip.MustParseAddr("10.1.2.3")
+	now := time.Now()
+	enforced, ok := cfg.Targets["umc750"].PolicyFor(client, nil, now)
+	r.True(ok)
+	r.Equal([][2]int{{1, 100}}, enforced.AllowWrites)
+	shadow, ok := cfg.Targets["umc750"].shadow.PolicyFor(client, nil, now)
+	r.True(ok)
+	r.Equal([][2]int{{1, 10}}, shadow.AllowWrites)
+
+	vf2Shadow, ok := cfg.Targets["vf2"].shadow.PolicyFor(client, nil, now)
+	r.True(ok)
+	r.Equal([][2]int{{1, 10}}, vf2Shadow.AllowWrites)
+	_, ok = cfg.Targets["vf2"].shadow.PolicyFor(netip.MustParseAddr("10.2.0.1"), nil, now)
+	r.False(ok)
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	ctx := context.Background()
+
+	check := func(b *binding, line string) map[string]any {
+		buf.Reset()
+		cmd, err := message.ParseCommand([]byte(line))
+		r.NoError(err)
+		req := &Request{Client: b.client, Command: cmd, Time: now}
+		allowed, reason := b.policy.Allow(ctx, req)
+		b.compareShadow(ctx, logger, req, allowed, reason)
+		if buf.Len() == 0 {
+			return nil
+		}
+		var entry map[string]any
+		r.NoError(json.Unmarshal(buf.Bytes(), &entry))
+		return entry
+	}
+
+	b := &binding{client: client, policy: enforced, shadow: shadow, shadowed: true}
+	r.Nil(check(b, "?E5 1"))
+	entry := check(b, "?E50 1")
+	r.NotNil(entry)
+	r.Equal(true, entry["audit"])
+	r.Equal(true, entry["allow"])
+	r.Equal(false, entry["shadow_allow"])
+	r.Equal(denyWrite, entry["shadow_reason"])
+
+	// The shadow policy allows commands which the enforced policy does not.
+	entry = check(&binding{client: client, policy: enforced, shadow: vf2Shadow, shadowed: true}, "?Q999")
+	r.NotNil(entry)
+	r.Equal(false, entry["allow"])
+	r.Equal(true, entry["shadow_allow"])
+	r.Equal(denyUndocumented, entry["reason"])
+
+	// No shadow policy applies to the client.
+	b.shadow = nil
+	entry = check(b, "?E5 1")
+	r.Equal(denyNoPolicy, entry["shadow_reason"])
+}
+
+func TestInvalidShadowPolicy(t *testing.T) {
+	r := require.New(t)
+
+	cfg := &Config{
+		ShadowPolicy: &ShadowPolicy{
+			Policy: map[netip.Prefix]*Policy{
+				netip.MustParsePrefix("10.0.0.0/8"): {Schedule: "nope"},
+			},
+		},
+	}
+	r.ErrorContains(cfg.Expand(), "shadow_policy: policy 10.0.0.0/8: unknown schedule")
+}
+
+// syncBuffer collects log output from the proxy's goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// entries returns the decoded log entries with the given message.
+func (b *syncBuffer) entries(t testing.TB, msg string) []map[string]any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var ret []map[string]any
+	for _, line := range bytes.Split(bytes.TrimSpace(b.buf.Bytes()), []byte("\n")) {
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal(line, &entry))
+		if entry["msg"] == msg {
+			ret = append(ret, entry)
+		}
+	}
+	return ret
+}
+
+// Connections and commands which are not routed by an enforced policy are
+// still compared with the shadow policies.
+func TestShadowUnrouted(t *testing.T) {
+	r := require.New(t)
+
+	ctx := mdctest.NewStopperForTest(t)
+
+	d, err := dummy.New(ctx, "127.0.0.1:0")
+	r.NoError(err)
+
+	logs := &syncBuffer{}
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	newConfig := func(tokens ...string) *Config {
+		return &Config{
+			Bind: netip.AddrFrom4([4]byte{127, 0, 0, 1}),
+			IdentityPolicy: map[string]*Policy{
+				"alice": {},
+			},
+			Principals: map[string]*Principal{
+				"alice": {Tokens: tokens},
+			},
+			ShadowPolicy: &ShadowPolicy{
+				Policy: map[netip.Prefix]*Policy{
+					netip.MustParsePrefix("127.0.0.1/32"): {AllowReads: [][2]int{{1, 10}}},
+				},
+			},
+			Targets: map[string]*Target{
+				d.Addr().String(): {},
+			},
+		}
+	}
+	cfg := notify.VarOf(newConfig())
+	p, pConn := startProxy(t, ctx, cfg)
+
+	// The connection is dropped, since no policy or token can route it.
+	raw, err := net.Dial("tcp", pConn.Addr())
+	r.NoError(err)
+	_, err = io.ReadAll(raw)
+	r.NoError(err)
+	_ = raw.Close()
+	r.Eventually(func() bool {
+		return len(logs.entries(t, "shadow policy differs")) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	entry := logs.entries(t, "shadow policy differs")[0]
+	r.Equal(false, entry["allow"])
+	r.Equal(true, entry["shadow_allow"])
+	r.Equal(denyNoPolicy, entry["reason"])
+	r.Nil(entry["request"])
+
+	// Clients which may authenticate are accepted, but an unauthenticated
+	// command is not routed.
+	_, reconfigured := p.reconfigured.Get()
+	cfg.Set(newConfig(HashToken("s3cr3t")))
+	<-reconfigured
+
+	for _, line := range []string{"?Q600 5", "?Q600 50"} {
+		raw := dialProxy(t, pConn.Addr())
+		_, err := io.WriteString(raw, line+"\r\n")
+		r.NoError(err)
+		_, err = io.ReadAll(raw)
+		r.NoError(err)
+	}
+	r.Eventually(func() bool {
+		return len(logs.entries(t, "shadow policy differs")) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	entry = logs.entries(t, "shadow policy differs")[1]
+	r.Equal(false, entry["allow"])
+	r.Equal(true, entry["shadow_allow"])
+	r.Equal(float64(5), entry["request"].(map[string]any)["variable"])
+}
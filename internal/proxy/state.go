@@ -0,0 +1,146 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"vawter.tech/mdcmux/pkg/message"
+)
+
+// A machineState caches responses from an MDC host so that policy checks,
+// such as interlocks, do not multiply the traffic sent to the host. Cached
+// responses are discarded after a write is sent through the proxy.
+type machineState struct {
+	backend RoundTripper
+
+	mu struct {
+		sync.Mutex
+		entries map[string]cachedResponse
+		ttl     time.Duration
+	}
+}
+
+var _ RoundTripper = (*machineState)(nil)
+
+type cachedResponse struct {
+	expires time.Time
+	resp    message.Response
+}
+
+func newMachineState(backend RoundTripper) *machineState {
+	s := &machineState{backend: backend}
+	s.mu.entries = make(map[string]cachedResponse)
+	return s
+}
+
+// RoundTrip implements [RoundTripper]. Write commands are not permitted.
+func (s *machineState) RoundTrip(ctx context.Context, cmd message.Command) (message.Response, error) {
+	if cmd.IsWrite() {
+		return nil, errors.New("machine state is read-only")
+	}
+	key := cmd.String()
+	now := time.Now()
+
+	s.mu.Lock()
+	found, ok := s.mu.entries[key]
+	ttl := s.mu.ttl
+	s.mu.Unlock()
+	if ok && now.Before(found.expires) {
+		return found.resp, nil
+	}
+
+	resp, err := s.backend.RoundTrip(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	if ttl > 0 {
+		s.mu.Lock()
+		s.mu.entries[key] = cachedResponse{expires: now.Add(ttl), resp: resp}
+		s.mu.Unlock()
+	}
+	return resp, nil
+}
+
+// reset discards all cached responses.
+func (s *machineState) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.mu.entries)
+}
+
+// setTTL updates the cache duration.
+func (s *machineState) setTTL(ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mu.ttl = ttl
+}
+
+// responseFields splits a comma-separated response into its fields. Framing
+// characters and whitespace are removed.
+func responseFields(resp message.Response) []string {
+	buf, ok := resp.Buffer()
+	if !ok {
+		return nil
+	}
+	fields := strings.Split(strings.Trim(string(buf), "\x02\x17\r\n "), ",")
+	for idx := range fields {
+		fields[idx] = strings.Trim(fields[idx], " ()")
+	}
+	return fields
+}
+
+// readMode returns the machine's mode from a Q104 query.
+func readMode(ctx context.Context, backend RoundTripper) (string, error) {
+	resp, err := backend.RoundTrip(ctx, message.CommandMode)
+	if err != nil {
+		return "", err
+	}
+	fields := responseFields(resp)
+	if len(fields) != 2 || fields[0] != "MODE" {
+		return "", errors.New("unexpected mode response")
+	}
+	return fields[1], nil
+}
+
+// readStatus returns the program name and status from a Q500 query. The
+// program name will be empty if the machine reports only that it is busy.
+func readStatus(ctx context.Context, backend RoundTripper) (program, status string, _ error) {
+	resp, err := backend.RoundTrip(ctx, message.CommandThreeInOne)
+	if err != nil {
+		return "", "", err
+	}
+	fields := responseFields(resp)
+	switch {
+	case len(fields) >= 3 && fields[0] == "PROGRAM":
+		return fields[1], fields[2], nil
+	case len(fields) == 2 && fields[0] == "STATUS":
+		return "", fields[1], nil
+	default:
+		return "", "", errors.New("unexpected status response")
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"vawter.tech/mdcmux/pkg/message"
+)
+
+// Types of symbols.
+const (
+	SymbolBoolean = "boolean"
+	SymbolInteger = "integer"
+	SymbolNumber  = "number"
+)
+
+// denySymbolType is reported when a written value does not match the type of
+// the variable's symbol.
+const denySymbolType = "value does not match symbol type"
+
+var (
+	// symbolOperand matches a command whose first operand is a symbol.
+	// Commands other than those in symbolPattern are rejected by resolve.
+	symbolOperand = regexp.MustCompile(`^\?[A-Za-z0-9]*\s*@`)
+	// symbolName is the form of a symbol's name.
+	symbolName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	// symbolPattern matches the extended command syntax, which refers to a
+	// macro variable by name, such as ?Q600 @PALLET_READY or
+	// ?E @PALLET_READY 1.
+	symbolPattern = regexp.MustCompile(`^\?(E|Q600)\s*@([A-Za-z0-9_]+)(.*)$`)
+)
+
+// A Symbol names a macro variable.
+type Symbol struct {
+	// Type is one of "number", "integer", or "boolean". Writes of values
+	// which do not match the type are denied. Defaults to "number".
+	Type string `json:"type"`
+	// Units describes the units of the variable's value, such as "mm".
+	Units string `json:"units"`
+	// Variable is the macro variable number.
+	Variable int `json:"variable"`
+}
+
+// accepts returns true if the value is compatible with the symbol's type.
+func (s *Symbol) accepts(value message.Number) bool {
+	switch s.Type {
+	case SymbolBoolean:
+		return value.Equal(message.Int(0)) || value.Equal(message.Int(1))
+	case SymbolInteger:
+		return !value.IsNaN() && value.Frac() == 0
+	default:
+		return true
+	}
+}
+
+func (s *Symbol) validate() error {
+	switch s.Type {
+	case "", SymbolBoolean, SymbolInteger, SymbolNumber:
+	default:
+		return fmt.Errorf("unknown type %q", s.Type)
+	}
+	if s.Variable < 0 {
+		return fmt.Errorf("invalid variable %d", s.Variable)
+	}
+	return nil
+}
+
+// A SymbolTable maps names to macro variables for a target. Names are not
+// case-sensitive. A nil SymbolTable is empty.
+type SymbolTable struct {
+	byName     map[string]string // Upper-case name to configured name.
+	byVariable map[int]string    // Variable to configured name.
+	symbols    map[string]*Symbol
+}
+
+// newSymbolTable combines the global and per-target symbols. Per-target
+// symbols replace global symbols with the same name.
+func newSymbolTable(global, local map[string]*Symbol) (*SymbolTable, error) {
+	if len(global) == 0 && len(local) == 0 {
+		return nil, nil
+	}
+	ret := &SymbolTable{
+		byName:     make(map[string]string),
+		byVariable: make(map[int]string),
+		symbols:    make(map[string]*Symbol),
+	}
+	for _, block := range []map[string]*Symbol{global, local} {
+		for name, sym := range block {
+			if !symbolName.MatchString(name) {
+				return nil, fmt.Errorf("invalid symbol name %q", name)
+			}
+			if err := sym.validate(); err != nil {
+				return nil, fmt.Errorf("symbol %s: %w", name, err)
+			}
+			key := strings.ToUpper(name)
+			if prev, ok := ret.byName[key]; ok {
+				delete(ret.symbols, prev)
+			}
+			ret.byName[key] = name
+			ret.symbols[name] = sym
+		}
+	}
+	for name, sym := range ret.symbols {
+		if other, ok := ret.byVariable[sym.Variable]; ok {
+			first, second := min(name, other), max(name, other)
+			return nil, fmt.Errorf("symbols %s and %s both name variable %d", first, second, sym.Variable)
+		}
+		ret.byVariable[sym.Variable] = name
+	}
+	return ret, nil
+}
+
+// Lookup returns the configured name and definition of a symbol.
+func (t *SymbolTable) Lookup(name string) (string, *Symbol, bool) {
+	if t == nil {
+		return "", nil, false
+	}
+	configured, ok := t.byName[strings.ToUpper(name)]
+	if !ok {
+		return "", nil, false
+	}
+	return configured, t.symbols[configured], true
+}
+
+// Name returns the symbol which names the variable.
+func (t *SymbolTable) Name(variable int) (string, *Symbol, bool) {
+	if t == nil {
+		return "", nil, false
+	}
+	name, ok := t.byVariable[variable]
+	if !ok {
+		return "", nil, false
+	}
+	return name, t.symbols[name], true
+}
+
+// SymbolTable returns the symbols of a target. The target may be a
+// hostname:port key or an unambiguous hostname. Only the symbols are
+// validated, so the configuration need not have been expanded.
+func (c *Config) SymbolTable(target string) (*SymbolTable, error) {
+	dest, err := c.findTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	table, err := newSymbolTable(c.Symbols, c.Targets[dest].Symbols)
+	if err != nil {
+		return nil, fmt.Errorf("target %s: %w", dest, err)
+	}
+	return table, nil
+}
+
+// isSymbolic returns true if the line uses the extended command syntax. A
+// '@' elsewhere in the line, such as in a payload, does not count.
+func isSymbolic(line []byte) bool {
+	return symbolOperand.Match(line)
+}
+
+// resolve rewrites a line which uses the extended command syntax to refer
+// to the variable by number.
+func (t *SymbolTable) resolve(line []byte) ([]byte, error) {
+	match := symbolPattern.FindSubmatch(line)
+	if match == nil {
+		return nil, fmt.Errorf("invalid symbolic command %q", line)
+	}
+	_, sym, ok := t.Lookup(string(match[2]))
+	if !ok {
+		return nil, fmt.Errorf("unknown symbol %q", match[2])
+	}
+	ret := append([]byte{'?'}, match[1]...)
+	if match[1][0] == 'Q' {
+		ret = append(ret, ' ')
+	}
+	ret = strconv.AppendInt(ret, int64(sym.Variable), 10)
+	return append(ret, match[3]...), nil
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"vawter.tech/mdcmux/internal/mdctest"
+	"vawter.tech/mdcmux/pkg/dummy"
+	"vawter.tech/mdcmux/pkg/message"
+	"vawter.tech/notify"
+)
+
+func TestSymbols(t *testing.T) {
+	r := require.New(t)
+
+	ctx := mdctest.NewStopperForTest(t)
+
+	d, err := dummy.New(ctx, "127.0.0.1:0")
+	r.NoError(err)
+
+	cfg := notify.VarOf(&Config{
+		Bind: netip.AddrFrom4([4]byte{127, 0, 0, 1}),
+		Policy: map[netip.Prefix]*Policy{
+			netip.MustParsePrefix("127.0.0.1/32"): {
+				AllowWrites: [][2]int{{1, 100}},
+				Remap:       []*Remap{{Variables: [2]int{1, 100}, To: 1000}},
+			},
+		},
+		Symbols: map[string]*Symbol{
+			"PALLET_READY": {Type: SymbolBoolean, Variable: 10},
+			"OFFSET":       {Type: SymbolNumber, Units: "mm", Variable: 20},
+		},
+		Targets: map[string]*Target{
+			d.Addr().String(): {
+				Symbols: map[string]*Symbol{
+					"OFFSET": {Type: SymbolInteger, Variable: 21},
+				},
+			},
+		},
+	})
+	_, pConn := startProxy(t, ctx, cfg)
+
+	send := dialSession(t, pConn.Addr()).send
+
+	// Symbols refer to the MDC host's variables and are not remapped.
+	r.Equal("!", send("?E @PALLET_READY 1"))
+	found, ok := d.Peek(message.Int(10))
+	r.True(ok)
+	r.Equal(message.Int(1), found)
+	r.Equal("MACRO, 1.0", send("?Q600 @pallet_ready"))
+
+	r.Equal("?, MDCMUX INVALID VALUE", send("?E @PALLET_READY 2"))
+	r.Equal("?, MDCMUX INVALID VALUE", send("?E @OFFSET 1.5"))
+	r.Equal("!", send("?E@OFFSET 2"))
+	found, ok = d.Peek(message.Int(21))
+	r.True(ok)
+	r.Equal(message.Int(2), found)
+
+	r.Equal("?, MDCMUX UNKNOWN SYMBOL", send("?Q600 @NOWHERE"))
+	r.Equal("?, MDCMUX UNKNOWN SYMBOL", send("?Q102 @OFFSET"))
+}
+
+func TestSymbolTable(t *testing.T) {
+	r := require.New(t)
+
+	table, err := newSymbolTable(
+		map[string]*Symbol{"A": {Variable: 1}, "B": {Variable: 2}},
+		map[string]*Symbol{"a": {Variable: 3}})
+	r.NoError(err)
+	name, sym, ok := table.Lookup("A")
+	r.True(ok)
+	r.Equal("a", name)
+	r.Equal(3, sym.Variable)
+	_, _, ok = table.Name(1)
+	r.False(ok)
+	name, _, ok = table.Name(2)
+	r.True(ok)
+	r.Equal("B", name)
+
+	line, err := table.resolve([]byte("?E @b -1.5"))
+	r.NoError(err)
+	r.Equal("?E2 -1.5", string(line))
+
+	r.True(isSymbolic([]byte("?E @b -1.5")))
+	r.True(isSymbolic([]byte("?Q600@b")))
+	r.False(isSymbolic([]byte("?Q600 2")))
+	r.False(isSymbolic([]byte("?E2 1 @b")))
+	r.True(isSymbolic([]byte("?Q102 @b")))
+
+	_, err = newSymbolTable(map[string]*Symbol{"A": {Variable: 1}, "B": {Variable: 1}}, nil)
+	r.ErrorContains(err, "symbols A and B both name variable 1")
+	_, err = newSymbolTable(map[string]*Symbol{"1A": {Variable: 1}}, nil)
+	r.ErrorContains(err, "invalid symbol name")
+	_, err = newSymbolTable(map[string]*Symbol{"A": {Type: "string"}}, nil)
+	r.ErrorContains(err, `unknown type "string"`)
+
+	var empty *SymbolTable
+	_, _, ok = empty.Name(1)
+	r.False(ok)
+}
+
+func TestConfigSymbolTable(t *testing.T) {
+	r := require.New(t)
+
+	// The configuration is not expanded, so the key pair is not loaded.
+	cfg := &Config{
+		Symbols: map[string]*Symbol{"PALLET_READY": {Variable: 500}},
+		TLS:     &TLS{Cert: "does-not-exist.crt", Key: "does-not-exist.key"},
+		Targets: map[string]*Target{
+			"umc750:5051": {Symbols: map[string]*Symbol{"OFFSET": {Variable: 600}}},
+		},
+	}
+	table, err := cfg.SymbolTable("umc750")
+	r.NoError(err)
+	_, sym, ok := table.Lookup("pallet_ready")
+	r.True(ok)
+	r.Equal(500, sym.Variable)
+	_, sym, ok = table.Lookup("OFFSET")
+	r.True(ok)
+	r.Equal(600, sym.Variable)
+
+	cfg.Targets["umc750:5051"].Symbols["OTHER"] = &Symbol{Variable: 500}
+	_, err = cfg.SymbolTable("umc750")
+	r.ErrorContains(err, "target umc750:5051: symbols")
+}
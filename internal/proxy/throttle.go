@@ -0,0 +1,213 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"vawter.tech/mdcmux/pkg/message"
+)
+
+// Reasons reported when a write is denied by a rate limit.
+const (
+	denyWriteBudget   = "target write budget exceeded"
+	denyWriteCooldown = "write cooldown"
+	denyWriteLimit    = "write rate limit exceeded"
+)
+
+// A WriteBudget limits the rate of writes to a target from all sessions.
+type WriteBudget struct {
+	// Cooldown is the length of time for which writes from the session that
+	// exceeded the budget are denied. Defaults to the interval.
+	Cooldown time.Duration `json:"cooldown"`
+	// Interval is the length of the sliding window in which writes are
+	// counted.
+	Interval time.Duration `json:"interval"`
+	// Writes is the number of writes permitted in each interval.
+	Writes int `json:"writes"`
+}
+
+func (b *WriteBudget) validate() error {
+	return validateRate(b.Writes, b.Interval, b.Cooldown)
+}
+
+// A WriteLimit restricts the rate at which a session may write to a range of
+// macro variables.
+type WriteLimit struct {
+	// Cooldown is the length of time for which all writes from the session
+	// are denied once the limit is exceeded. Defaults to the interval.
+	Cooldown time.Duration `json:"cooldown"`
+	// Interval is the length of the sliding window in which writes are
+	// counted.
+	Interval time.Duration `json:"interval"`
+	// Variables is an inclusive range of macro variable numbers.
+	Variables [2]int `json:"variables"`
+	// Writes is the number of writes permitted in each interval.
+	Writes int `json:"writes"`
+}
+
+func (l *WriteLimit) validate() error {
+	if l.Variables[0] > l.Variables[1] {
+		return fmt.Errorf("invalid variable range %v", l.Variables)
+	}
+	return validateRate(l.Writes, l.Interval, l.Cooldown)
+}
+
+func validateRate(writes int, interval, cooldown time.Duration) error {
+	if writes <= 0 {
+		return errors.New("writes must be positive")
+	}
+	if interval <= 0 {
+		return errors.New("interval must be positive")
+	}
+	if cooldown < 0 {
+		return errors.New("cooldown must not be negative")
+	}
+	return nil
+}
+
+// cooldownOr returns the cooldown, or the interval if no cooldown is set.
+func cooldownOr(cooldown, interval time.Duration) time.Duration {
+	if cooldown == 0 {
+		return interval
+	}
+	return cooldown
+}
+
+// A rateWindow counts events within a sliding window.
+type rateWindow struct {
+	times []time.Time
+}
+
+// take records an event and returns true if fewer than limit events were
+// recorded within the preceding interval. A denied event is not recorded.
+func (w *rateWindow) take(now time.Time, limit int, interval time.Duration) bool {
+	w.prune(now, interval)
+	if len(w.times) >= limit {
+		return false
+	}
+	w.times = append(w.times, now)
+	return true
+}
+
+// add records an event and returns the number of events within the
+// preceding interval, including the new event.
+func (w *rateWindow) add(now time.Time, interval time.Duration) int {
+	w.prune(now, interval)
+	w.times = append(w.times, now)
+	return len(w.times)
+}
+
+// prune discards events which are older than the interval.
+func (w *rateWindow) prune(now time.Time, interval time.Duration) {
+	cutoff := now.Add(-interval)
+	idx := 0
+	for idx < len(w.times) && !w.times[idx].After(cutoff) {
+		idx++
+	}
+	w.times = append(w.times[:0], w.times[idx:]...)
+}
+
+// writeThrottle tracks the writes made by a session. It is only accessed
+// from the session's goroutine.
+type writeThrottle struct {
+	cooldown time.Time // Writes are denied until this time.
+	windows  map[*WriteLimit]*rateWindow
+}
+
+// window returns the counter for the limit. Counters are keyed by the limit,
+// so they restart when the configuration is reloaded.
+func (t *writeThrottle) window(limit *WriteLimit) *rateWindow {
+	if t.windows == nil {
+		t.windows = make(map[*WriteLimit]*rateWindow)
+	}
+	w := t.windows[limit]
+	if w == nil {
+		w = &rateWindow{}
+		t.windows[limit] = w
+	}
+	return w
+}
+
+// throttle enforces the session's write limits and the target's write
+// budget. It returns a non-empty reason if the write must be denied. Reads
+// are not affected.
+func (p *Proxy) throttle(
+	ctx context.Context, logger *slog.Logger, sess *session, b *binding, cmd message.Command,
+) string {
+	if !cmd.IsWrite() {
+		return ""
+	}
+	now := time.Now()
+	t := &sess.writes
+	if now.Before(t.cooldown) {
+		return denyWriteCooldown
+	}
+	v, _ := cmd.Variable()
+	variable := int(v.Whole())
+	for _, limit := range b.policy.WriteLimits {
+		if variable < limit.Variables[0] || variable > limit.Variables[1] {
+			continue
+		}
+		if !t.window(limit).take(now, limit.Writes, limit.Interval) {
+			return t.trip(ctx, logger, cmd, denyWriteLimit, now,
+				cooldownOr(limit.Cooldown, limit.Interval))
+		}
+	}
+	if budget := b.target.WriteBudget; budget != nil {
+		p.budgets.Lock()
+		w := p.budgets.byHostname[b.mdc.Addr()]
+		if w == nil {
+			w = &rateWindow{}
+			p.budgets.byHostname[b.mdc.Addr()] = w
+		}
+		ok := w.take(now, budget.Writes, budget.Interval)
+		p.budgets.Unlock()
+		if !ok {
+			return t.trip(ctx, logger, cmd, denyWriteBudget, now, cooldownOr(budget.Cooldown, budget.Interval))
+		}
+	}
+	return ""
+}
+
+// trip starts a cooldown period and raises an audit event.
+func (t *writeThrottle) trip(
+	ctx context.Context,
+	logger *slog.Logger,
+	cmd message.Command,
+	reason string,
+	now time.Time,
+	cooldown time.Duration,
+) string {
+	t.cooldown = now.Add(cooldown)
+	logger.LogAttrs(ctx, slog.LevelError, "write storm",
+		slog.Bool("audit", true),
+		slog.Any("request", cmd),
+		slog.String("reason", reason),
+		slog.Duration("cooldown", cooldown))
+	return reason
+}
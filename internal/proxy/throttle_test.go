@@ -0,0 +1,104 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"vawter.tech/mdcmux/internal/mdctest"
+	"vawter.tech/mdcmux/pkg/dummy"
+	"vawter.tech/notify"
+)
+
+func TestWriteThrottle(t *testing.T) {
+	r := require.New(t)
+
+	ctx := mdctest.NewStopperForTest(t)
+
+	d, err := dummy.New(ctx, "127.0.0.1:0")
+	r.NoError(err)
+
+	cfg := notify.VarOf(&Config{
+		Bind: netip.AddrFrom4([4]byte{127, 0, 0, 1}),
+		Policy: map[netip.Prefix]*Policy{
+			netip.MustParsePrefix("127.0.0.1/32"): {
+				AllowWrites: [][2]int{{1, 100}},
+				WriteLimits: []*WriteLimit{
+					{Variables: [2]int{1, 10}, Writes: 2, Interval: time.Hour, Cooldown: 500 * time.Millisecond},
+				},
+			},
+		},
+		Targets: map[string]*Target{
+			d.Addr().String(): {},
+		},
+		WriteBudget: &WriteBudget{Writes: 5, Interval: time.Hour},
+	})
+	_, pConn := startProxy(t, ctx, cfg)
+
+	dial := func() func(string) string {
+		return dialSession(t, pConn.Addr()).send
+	}
+
+	send := dial()
+	r.Equal("!", send("?E5 1"))
+	r.Equal("!", send("?E6 2"))
+	r.Equal("?, MDCMUX WRITE LIMIT", send("?E7 3"))
+	// All writes from the session are denied during the cooldown.
+	r.Equal("?, MDCMUX WRITE LIMIT", send("?E50 4"))
+	// Reads are not affected.
+	r.Equal("MACRO, 2.0", send("?Q600 6"))
+
+	// Other sessions have their own limits.
+	other := dial()
+	r.Equal("!", other("?E5 1"))
+	r.Equal("!", other("?E50 1"))
+
+	// Once the cooldown has elapsed, other variables may be written. Writes
+	// denied during the cooldown do not count towards the budget.
+	r.Eventually(func() bool { return send("?E50 5") == "!" }, 5*time.Second, 50*time.Millisecond)
+	// The limit on the first variables still applies.
+	r.Equal("?, MDCMUX WRITE LIMIT", send("?E5 1"))
+
+	// The target's budget of five writes has been used.
+	r.Equal("?, MDCMUX WRITE LIMIT", other("?E51 1"))
+	r.Equal("?, MDCMUX WRITE LIMIT", dial()("?E51 1"))
+}
+
+func TestWriteLimitValidation(t *testing.T) {
+	r := require.New(t)
+
+	cfg := &Config{
+		Policy: map[netip.Prefix]*Policy{
+			netip.MustParsePrefix("10.0.0.0/8"): {
+				WriteLimits: []*WriteLimit{{Variables: [2]int{1, 10}, Interval: time.Second}},
+			},
+		},
+	}
+	r.ErrorContains(cfg.Expand(), "writes must be positive")
+
+	cfg = &Config{WriteBudget: &WriteBudget{Writes: 1}}
+	r.ErrorContains(cfg.Expand(), "write_budget: interval must be positive")
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// TLS configures a TLS listener. The files are read each time the
+// configuration is loaded.
+type TLS struct {
+	// Cert is the path to a PEM-encoded certificate chain.
+	Cert string `json:"cert"`
+	// Key is the path to the PEM-encoded private key for Cert.
+	Key string `json:"key"`
+	// ClientCA is the path to a PEM-encoded bundle of certificate
+	// authorities. If set, clients must present a certificate signed by one
+	// of the authorities.
+	ClientCA string `json:"client_ca"`
+
+	config *tls.Config
+}
+
+// load reads the certificate files.
+func (t *TLS) load() error {
+	if t.Cert == "" || t.Key == "" {
+		return errors.New("tls requires both a cert and a key")
+	}
+	cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+	if err != nil {
+		return fmt.Errorf("could not load tls certificate: %w", err)
+	}
+	t.config = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if t.ClientCA != "" {
+		data, err := os.ReadFile(t.ClientCA)
+		if err != nil {
+			return fmt.Errorf("could not read client ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in %s", t.ClientCA)
+		}
+		t.config.ClientAuth = tls.RequireAndVerifyClientCert
+		t.config.ClientCAs = pool
+	}
+	return nil
+}
+
+// certIdentities returns the subject common name and subject alternate names
+// of the certificate, which are used as client identities.
+func certIdentities(cert *x509.Certificate) []string {
+	var ret []string
+	if cn := cert.Subject.CommonName; cn != "" {
+		ret = append(ret, cn)
+	}
+	ret = append(ret, cert.DNSNames...)
+	ret = append(ret, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		ret = append(ret, u.String())
+	}
+	return ret
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"vawter.tech/mdcmux/internal/mdctest"
+	"vawter.tech/mdcmux/pkg/dummy"
+	"vawter.tech/mdcmux/pkg/message"
+	"vawter.tech/notify"
+)
+
+func TestTLS(t *testing.T) {
+	r := require.New(t)
+
+	ctx := mdctest.NewStopperForTest(t)
+
+	d, err := dummy.New(ctx, "127.0.0.1:0")
+	r.NoError(err)
+
+	dir := t.TempDir()
+	ca, caKey := testCert(t, dir, "ca", nil, nil)
+	testCert(t, dir, "server", ca, caKey)
+	testCert(t, dir, "alice", ca, caKey)
+
+	cfg := notify.VarOf(&Config{
+		Bind: netip.AddrFrom4([4]byte{127, 0, 0, 1}),
+		IdentityPolicy: map[string]*Policy{
+			"group:engineering": {
+				AllowWrites: [][2]int{{1, 10}},
+			},
+		},
+		Principals: map[string]*Principal{
+			"alice": {Groups: []string{"engineering"}},
+		},
+		TLS: &TLS{
+			Cert:     filepath.Join(dir, "server.crt"),
+			Key:      filepath.Join(dir, "server.key"),
+			ClientCA: filepath.Join(dir, "ca.crt"),
+		},
+		Targets: map[string]*Target{
+			d.Addr().String(): {},
+		},
+	})
+	_, pConn := startProxy(t, ctx, cfg)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	t.Run("client_cert", func(t *testing.T) {
+		r := require.New(t)
+
+		cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "alice.crt"), filepath.Join(dir, "alice.key"))
+		r.NoError(err)
+
+		raw, err := tls.Dial("tcp", pConn.Addr(), &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      roots,
+		})
+		r.NoError(err)
+		defer func() { _ = raw.Close() }()
+
+		in := bufio.NewScanner(raw)
+		in.Split(message.ScanPrompt)
+
+		_, err = io.WriteString(raw, "?E5 1.5\r\n")
+		r.NoError(err)
+		r.True(in.Scan())
+		r.Equal("!", in.Text())
+
+		// The group policy does not allow this write.
+		_, err = io.WriteString(raw, "?E50 1.5\r\n")
+		r.NoError(err)
+		r.True(in.Scan())
+		r.Equal("?, MDCMUX DENY POLICY", in.Text())
+	})
+
+	t.Run("no_client_cert", func(t *testing.T) {
+		r := require.New(t)
+
+		raw, err := tls.Dial("tcp", pConn.Addr(), &tls.Config{RootCAs: roots})
+		if err == nil {
+			defer func() { _ = raw.Close() }()
+			// TLS 1.3 reports a missing client certificate after the
+			// client has finished its half of the handshake.
+			_, err = io.ReadAll(raw)
+		}
+		r.Error(err)
+	})
+
+	t.Run("plaintext", func(t *testing.T) {
+		r := require.New(t)
+
+		raw, err := net.Dial("tcp", pConn.Addr())
+		r.NoError(err)
+		defer func() { _ = raw.Close() }()
+		_, _ = io.WriteString(raw, "?Q102\r\n")
+		buf, _ := io.ReadAll(raw)
+		r.NotContains(string(buf), "MDCMUX")
+	})
+}
+
+// testCert writes a PEM-encoded certificate and key to the directory. A
+// self-signed CA certificate is created if parent is nil.
+func testCert(
+	t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey,
+) (*x509.Certificate, *ecdsa.PrivateKey) {
+	r := require.New(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	r.NoError(err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	if parent == nil {
+		tmpl.BasicConstraintsValid = true
+		tmpl.IsCA = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	r.NoError(err)
+	cert, err := x509.ParseCertificate(der)
+	r.NoError(err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	r.NoError(err)
+
+	r.NoError(os.WriteFile(filepath.Join(dir, name+".crt"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	r.NoError(os.WriteFile(filepath.Join(dir, name+".key"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return cert, key
+}
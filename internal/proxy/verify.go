@@ -0,0 +1,69 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"context"
+	"log/slog"
+
+	"vawter.tech/mdcmux/pkg/message"
+)
+
+// verifyWrite reads back a variable after a successful write, if required by
+// the policy, and returns false if the stored value differs from the value
+// which was sent. Discrepancies are always logged.
+func verifyWrite(
+	ctx context.Context, logger *slog.Logger, b *binding, cmd message.Command, resp message.Response,
+) bool {
+	if !b.policy.VerifyWrites || !cmd.IsWrite() || !resp.IsSuccess() {
+		return true
+	}
+	v, _ := cmd.Variable()
+	want, _ := cmd.Value()
+
+	attrs := []slog.Attr{
+		slog.Bool("audit", true),
+		slog.Any("request", cmd),
+	}
+	// Don't use the machine state cache, which may be stale.
+	readback, err := b.backend.RoundTrip(ctx, message.QueryCommand(v))
+	if err != nil {
+		logger.LogAttrs(ctx, slog.LevelWarn, "could not verify write",
+			append(attrs, slog.Any("error", err))...)
+		return false
+	}
+	got, ok := readback.Value()
+	if !ok {
+		logger.LogAttrs(ctx, slog.LevelWarn, "could not verify write",
+			append(attrs, slog.Any("response", readback))...)
+		return false
+	}
+	if !got.Equal(want) {
+		logger.LogAttrs(ctx, slog.LevelWarn, "write verification failed",
+			append(attrs,
+				slog.String("expected", want.String()),
+				slog.String("actual", got.String()))...)
+		return false
+	}
+	return true
+}
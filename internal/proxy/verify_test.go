@@ -0,0 +1,77 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"vawter.tech/mdcmux/internal/mdctest"
+	"vawter.tech/mdcmux/pkg/dummy"
+	"vawter.tech/mdcmux/pkg/message"
+	"vawter.tech/notify"
+)
+
+func TestVerifyWrites(t *testing.T) {
+	r := require.New(t)
+
+	ctx := mdctest.NewStopperForTest(t)
+
+	d, err := dummy.New(ctx, "127.0.0.1:0")
+	r.NoError(err)
+	// Simulate a control which only stores a single decimal place.
+	d.OnWrite(func(_, value message.Number) message.Number {
+		ret, err := message.ParseNumber([]byte(fmt.Sprintf("%.1f", value.Float64())))
+		r.NoError(err)
+		return ret
+	})
+
+	cfg := notify.VarOf(&Config{
+		Bind: netip.AddrFrom4([4]byte{127, 0, 0, 1}),
+		Policy: map[netip.Prefix]*Policy{
+			netip.MustParsePrefix("127.0.0.1/32"): {
+				AllowWrites:  [][2]int{{1, 100}},
+				VerifyWrites: true,
+			},
+		},
+		Targets: map[string]*Target{
+			d.Addr().String(): {},
+		},
+	})
+	_, pConn := startProxy(t, ctx, cfg)
+
+	resp, err := pConn.RoundTrip(ctx, message.WriteCommand(message.Int(5), message.NewNumber(1, 5)))
+	r.NoError(err)
+	r.Equal("!", resp.(fmt.Stringer).String())
+
+	resp, err = pConn.RoundTrip(ctx, message.WriteCommand(message.Int(5), message.NewNumber(1, 25)))
+	r.NoError(err)
+	r.Equal("?, MDCMUX VERIFY FAILED", resp.(fmt.Stringer).String())
+
+	// The control's value is reported.
+	resp, err = pConn.RoundTrip(ctx, message.QueryCommand(message.Int(5)))
+	r.NoError(err)
+	r.Equal("MACRO, 1.2", resp.(fmt.Stringer).String())
+}
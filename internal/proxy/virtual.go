@@ -0,0 +1,173 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"vawter.tech/mdcmux/pkg/message"
+)
+
+// Virtual configures a range of macro variables which are hosted by the
+// proxy. Commands which refer to these variables are answered by the proxy
+// and are never sent to the MDC host. They are subject to the same policy
+// checks as the MDC host's variables.
+type Virtual struct {
+	// File is the path of a file in which the values are stored. Values
+	// are not retained across restarts if empty.
+	File string `json:"file"`
+	// Variables is an inclusive range of macro variable numbers.
+	Variables [2]int `json:"variables"`
+}
+
+func (v *Virtual) contains(variable message.Number) bool {
+	w := variable.Whole()
+	return variable.Frac() == 0 &&
+		int64(v.Variables[0]) <= w && w <= int64(v.Variables[1])
+}
+
+func (v *Virtual) validate() error {
+	if v.Variables[0] > v.Variables[1] {
+		return fmt.Errorf("invalid variable range %v", v.Variables)
+	}
+	return nil
+}
+
+// A virtualStore holds the values of virtual variables for a target.
+type virtualStore struct {
+	path string
+
+	mu     sync.Mutex
+	values map[int64]message.Number
+}
+
+// openVirtual creates a store, loading any values from the file.
+func openVirtual(path string) (*virtualStore, error) {
+	ret := &virtualStore{path: path, values: make(map[int64]message.Number)}
+	if path == "" {
+		return ret, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stored map[string]string
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for k, v := range stored {
+		variable, err := strconv.ParseInt(k, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid variable %q", path, k)
+		}
+		value, err := message.ParseNumber([]byte(v))
+		if err != nil {
+			return nil, fmt.Errorf("%s: variable %d: %w", path, variable, err)
+		}
+		ret.values[variable] = value
+	}
+	return ret, nil
+}
+
+// roundTrip answers a query or write. Unset variables have a value of zero.
+func (s *virtualStore) roundTrip(cmd message.Command) (message.Response, error) {
+	v, _ := cmd.Variable()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !cmd.IsWrite() {
+		return message.QueryResponse(s.values[v.Whole()]), nil
+	}
+	value, _ := cmd.Value()
+	prev, existed := s.values[v.Whole()]
+	s.values[v.Whole()] = value
+	if err := s.saveLocked(); err != nil {
+		if existed {
+			s.values[v.Whole()] = prev
+		} else {
+			delete(s.values, v.Whole())
+		}
+		return nil, err
+	}
+	return message.OpaqueResponse([]byte("!"), true), nil
+}
+
+// saveLocked replaces the file with the current values.
+func (s *virtualStore) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	stored := make(map[string]string, len(s.values))
+	for k, v := range s.values {
+		stored[strconv.FormatInt(k, 10)] = v.String()
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// virtualBackend answers commands for virtual variables locally and sends
+// all other commands to the next RoundTripper.
+type virtualBackend struct {
+	next   RoundTripper
+	store  *virtualStore
+	config *Virtual
+}
+
+var _ RoundTripper = (*virtualBackend)(nil)
+
+// RoundTrip implements [RoundTripper].
+func (b *virtualBackend) RoundTrip(ctx context.Context, cmd message.Command) (message.Response, error) {
+	if v, ok := cmd.Variable(); ok && b.config.contains(v) {
+		return b.store.roundTrip(cmd)
+	}
+	return b.next.RoundTrip(ctx, cmd)
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"net/netip"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"vawter.tech/mdcmux/internal/mdctest"
+	"vawter.tech/mdcmux/pkg/dummy"
+	"vawter.tech/mdcmux/pkg/message"
+	"vawter.tech/notify"
+)
+
+func TestVirtual(t *testing.T) {
+	r := require.New(t)
+
+	ctx := mdctest.NewStopperForTest(t)
+
+	d, err := dummy.New(ctx, "127.0.0.1:0")
+	r.NoError(err)
+
+	path := filepath.Join(t.TempDir(), "virtual.json")
+	cfg := notify.VarOf(&Config{
+		Bind: netip.AddrFrom4([4]byte{127, 0, 0, 1}),
+		Policy: map[netip.Prefix]*Policy{
+			netip.MustParsePrefix("127.0.0.1/32"): {
+				AllowWrites: [][2]int{{1, 100}, {900, 949}},
+				WriteRules: []*WriteRule{
+					{Variables: [2]int{910, 919}, MaxChange: 1},
+				},
+			},
+		},
+		Targets: map[string]*Target{
+			d.Addr().String(): {
+				Virtual: &Virtual{File: path, Variables: [2]int{900, 999}},
+			},
+		},
+	})
+	_, pConn := startProxy(t, ctx, cfg)
+
+	dial := func() func(string) string {
+		return dialSession(t, pConn.Addr()).send
+	}
+
+	send := dial()
+	r.Equal("MACRO, 0.0", send("?Q600 900"))
+	r.Equal("!", send("?E900 1.05"))
+	r.Equal("MACRO, 1.05", send("?Q600 900"))
+	_, ok := d.Peek(message.Int(900))
+	r.False(ok)
+
+	// Virtual variables are shared between clients.
+	r.Equal("MACRO, 1.05", dial()("?Q600 900"))
+
+	// Policies apply to virtual variables.
+	r.Equal("?, MDCMUX DENY POLICY", send("?E950 1"))
+	r.Equal("?, MDCMUX DENY POLICY", send("?E910 5"))
+	r.Equal("!", send("?E910 0.5"))
+
+	// Other variables are sent to the MDC host.
+	r.Equal("!", send("?E5 2"))
+	found, ok := d.Peek(message.Int(5))
+	r.True(ok)
+	r.Equal(message.Int(2), found)
+
+	// Values are persisted.
+	store, err := openVirtual(path)
+	r.NoError(err)
+	resp, err := store.roundTrip(message.QueryCommand(message.Int(900)))
+	r.NoError(err)
+	r.Equal("MACRO, 1.05", resp.String())
+}
+
+func TestInvalidVirtual(t *testing.T) {
+	r := require.New(t)
+
+	cfg := &Config{Targets: map[string]*Target{
+		"127.0.0.1:5051": {Virtual: &Virtual{Variables: [2]int{2, 1}}},
+	}}
+	r.ErrorContains(cfg.Expand(), "virtual: invalid variable range")
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"log/slog"
+
+	"vawter.tech/mdcmux/pkg/message"
+)
+
+// xauthPrefix introduces the in-band authentication command. The command is
+// an mdcmux extension and is never sent to the MDC host.
+var xauthPrefix = []byte("?XAUTH")
+
+// isXAuth returns true if the line is an XAUTH command.
+func isXAuth(line []byte) bool {
+	rest, ok := bytes.CutPrefix(line, xauthPrefix)
+	return ok && (len(rest) == 0 || rest[0] == ' ' || rest[0] == '\t')
+}
+
+// xauth handles an XAUTH command of the form "?XAUTH <principal> <token>". A
+// successful command binds the session to the principal. Authentication must
+// happen before any commands have been proxied, so that a session cannot
+// switch identities part-way through. Until then, the session uses the
+// netblock policy for its source address, if any. A failed attempt leaves the
+// session unauthenticated. The token is never logged.
+func (p *Proxy) xauth(ctx context.Context, sess *session, line []byte) (bool, error) {
+	fields := bytes.Fields(line[len(xauthPrefix):])
+
+	// Drop any previous XAUTH identity, but retain certificate identities.
+	sess.creds.name = ""
+	sess.creds.digest = [sha256.Size]byte{}
+
+	reason := ""
+	var user string
+	switch {
+	case sess.proxied:
+		reason = rejectAuthLate
+	case len(fields) != 2:
+		reason = rejectAuth
+	default:
+		user = string(fields[0])
+		sess.creds.name = user
+		sess.creds.digest = sha256.Sum256(fields[1])
+		if b, ok := sess.router(); !ok || b.who == nil || b.who.name != user {
+			sess.creds.name = ""
+			sess.creds.digest = [sha256.Size]byte{}
+			reason = rejectAuth
+		}
+	}
+
+	if reason != "" {
+		auditReject(ctx, sess.logger, reason, slog.String("user", user))
+		p.fail(ctx, sess, failAuth)
+		return true, message.WriteResponse(sess.out, "?, MDCMUX AUTH FAILED")
+	}
+	sess.routed = true
+
+	sess.logger.LogAttrs(ctx, slog.LevelInfo, "authenticated",
+		slog.Bool("audit", true),
+		slog.String("principal", user))
+	return true, message.WriteResponse(sess.out, "!")
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package proxy
+
+import (
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"vawter.tech/mdcmux/internal/mdctest"
+	"vawter.tech/mdcmux/pkg/dummy"
+	"vawter.tech/notify"
+)
+
+func TestXAuth(t *testing.T) {
+	r := require.New(t)
+
+	ctx := mdctest.NewStopperForTest(t)
+
+	d, err := dummy.New(ctx, "127.0.0.1:0")
+	r.NoError(err)
+
+	newConfig := func(anonymous bool, tokens ...string) *Config {
+		cfg := &Config{
+			AuthTimeout: 100 * time.Millisecond,
+			Bind:        netip.AddrFrom4([4]byte{127, 0, 0, 1}),
+			IdentityPolicy: map[string]*Policy{
+				"alice": {AllowWrites: [][2]int{{1, 10}}},
+			},
+			Principals: map[string]*Principal{
+				"alice": {Tokens: tokens},
+			},
+			Targets: map[string]*Target{
+				d.Addr().String(): {},
+			},
+		}
+		if anonymous {
+			cfg.Policy = map[netip.Prefix]*Policy{
+				netip.MustParsePrefix("127.0.0.1/32"): {},
+			}
+		}
+		return cfg
+	}
+	cfg := notify.VarOf(newConfig(true, HashToken("s3cr3t")))
+	p, pConn := startProxy(t, ctx, cfg)
+
+	t.Run("anonymous", func(t *testing.T) {
+		r := require.New(t)
+		send := dialSession(t, pConn.Addr()).send
+		r.Equal("?, MDCMUX DENY POLICY", send("?E5 1"))
+	})
+
+	t.Run("authenticated", func(t *testing.T) {
+		r := require.New(t)
+		send := dialSession(t, pConn.Addr()).send
+		r.Equal("!", send("?XAUTH alice s3cr3t"))
+		r.Equal("!", send("?E5 1"))
+	})
+
+	t.Run("bad_token", func(t *testing.T) {
+		r := require.New(t)
+		send := dialSession(t, pConn.Addr()).send
+		r.Equal("?, MDCMUX AUTH FAILED", send("?XAUTH alice guess"))
+		r.Equal("?, MDCMUX AUTH FAILED", send("?XAUTH bob s3cr3t"))
+		r.Equal("?, MDCMUX AUTH FAILED", send("?XAUTH alice"))
+		r.Equal("?, MDCMUX DENY POLICY", send("?E5 1"))
+	})
+
+	t.Run("after_command", func(t *testing.T) {
+		r := require.New(t)
+		send := dialSession(t, pConn.Addr()).send
+		r.Equal("MODEL, MDCMUX", send("?Q102"))
+		r.Equal("?, MDCMUX AUTH FAILED", send("?XAUTH alice s3cr3t"))
+		r.Equal("?, MDCMUX DENY POLICY", send("?E5 1"))
+	})
+
+	t.Run("revoked", func(t *testing.T) {
+		r := require.New(t)
+		send := dialSession(t, pConn.Addr()).send
+		r.Equal("!", send("?XAUTH alice s3cr3t"))
+
+		_, reconfigured := p.reconfigured.Get()
+		cfg.Set(newConfig(true, HashToken("other")))
+		<-reconfigured
+
+		r.Equal("?, MDCMUX DENY POLICY", send("?E5 1"))
+	})
+
+	t.Run("no_anonymous_policy", func(t *testing.T) {
+		r := require.New(t)
+
+		_, reconfigured := p.reconfigured.Get()
+		cfg.Set(newConfig(false, HashToken("s3cr3t")))
+		<-reconfigured
+
+		send := dialSession(t, pConn.Addr()).send
+		r.Equal("!", send("?XAUTH alice s3cr3t"))
+		r.Equal("!", send("?E5 1"))
+
+		// Unauthenticated sessions are dropped.
+		raw := dialSession(t, pConn.Addr())
+		raw.write("?Q100")
+		buf, _ := io.ReadAll(raw)
+		r.Empty(buf)
+
+		// Sessions which must authenticate have less time to do so.
+		start := time.Now()
+		buf, _ = io.ReadAll(dialSession(t, pConn.Addr()))
+		r.Empty(buf)
+		r.Less(time.Since(start), time.Second)
+	})
+}
@@ -32,8 +32,11 @@ import (
 	"github.com/spf13/cobra"
 	"vawter.tech/mdcmux/cmd/dummy"
 	"vawter.tech/mdcmux/cmd/fetch"
+	"vawter.tech/mdcmux/cmd/journal"
 	"vawter.tech/mdcmux/cmd/legal"
 	"vawter.tech/mdcmux/cmd/mdcmux"
+	"vawter.tech/mdcmux/cmd/policy"
+	"vawter.tech/mdcmux/cmd/token"
 	"vawter.tech/stopper"
 )
 
@@ -65,8 +68,11 @@ func main() {
 	root.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "verbose output")
 	root.AddCommand(dummy.Command())
 	root.AddCommand(fetch.Command())
+	root.AddCommand(journal.Command())
 	root.AddCommand(legal.Command())
 	root.AddCommand(mdcmux.Command())
+	root.AddCommand(policy.Command())
+	root.AddCommand(token.Command())
 
 	ctx := stopper.WithContext(context.Background())
 	ctx.Go(func(ctx *stopper.Context) error {
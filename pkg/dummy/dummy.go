@@ -60,7 +60,8 @@ type Server struct {
 
 	mu struct {
 		sync.Mutex
-		data map[message.Number]message.Number
+		data    map[message.Number]message.Number
+		onWrite func(variable, value message.Number) message.Number
 	}
 }
 
@@ -150,12 +151,23 @@ func (s *Server) Poke(k, v message.Number) {
 	s.mu.data[k] = v
 }
 
+// OnWrite installs a function which may alter the values written by clients,
+// to simulate a control which rounds or clamps values.
+func (s *Server) OnWrite(fn func(variable, value message.Number) message.Number) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mu.onWrite = fn
+}
+
 func (s *Server) handle(_ *stopper.Context, msg message.Command, out *bufio.Writer) error {
 	if msg.IsWrite() {
 		num, _ := msg.Variable()
 		val, _ := msg.Value()
 
 		s.mu.Lock()
+		if s.mu.onWrite != nil {
+			val = s.mu.onWrite(num, val)
+		}
 		s.mu.data[num] = val
 		s.mu.Unlock()
 
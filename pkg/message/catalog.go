@@ -0,0 +1,76 @@
+// Copyright (c) 2025 Bob Vawter (bob@vawter.org)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+// SPDX-License-Identifier: MIT
+
+package message
+
+import (
+	"strconv"
+	"strings"
+)
+
+// catalog provides human-readable names for the documented Q commands.
+var catalog = []struct {
+	name string
+	n    Number
+}{
+	{"machine_sn", QMachineSN},
+	{"control_version", QControlVersion},
+	{"machine_model", QMachineModel},
+	{"mode", QMode},
+	{"tool_changes", QToolChanges},
+	{"tool_number", QToolNumber},
+	{"power_on_time", QPowerOnTime},
+	{"motion_time", QMotionTime},
+	{"last_cycle_time", QLastCycleTime},
+	{"previous_cycle_time", QPreviousCycleTime},
+	{"parts_counter_1", QPartsCounter1},
+	{"parts_counter_2", QPartsCounter2},
+	{"three_in_one", QThreeInOne},
+	{"macro_variable", QMacroVariable},
+}
+
+// CommandName returns the catalog name of a documented Q command.
+func CommandName(n Number) (string, bool) {
+	for _, entry := range catalog {
+		if entry.n == n {
+			return entry.name, true
+		}
+	}
+	return "", false
+}
+
+// LookupCommand returns the Q command number for a catalog name, such as
+// "three_in_one". A decimal command number, optionally prefixed with "Q", is
+// also accepted. Names are case-insensitive.
+func LookupCommand(name string) (Number, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, entry := range catalog {
+		if entry.name == name {
+			return entry.n, true
+		}
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(name, "q"))
+	if err != nil || n < 0 {
+		return Number{}, false
+	}
+	return Int(n), true
+}
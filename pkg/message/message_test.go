@@ -82,6 +82,10 @@ func TestFormatNumber(t *testing.T) {
 		{S: "-1.2", F: "%d", E: "-1"},
 
 		{S: "1.0", F: "%f", E: "1.0"},
+		{S: "1.05", F: "%f", E: "1.05"},
+		{S: "1.50", F: "%f", E: "1.5"},
+		{S: "-0.5", F: "%f", E: "-0.5"},
+		{S: "-0.0", F: "%f", E: "0.0"},
 
 		{S: "1.0", F: "%.0f", E: "1"},
 		{S: "1.0", F: "%.0s", E: "1"},
@@ -271,3 +275,47 @@ func TestParseNumber(t *testing.T) {
 		})
 	}
 }
+
+func TestNumberEqual(t *testing.T) {
+	r := require.New(t)
+
+	parse := func(s string) Number {
+		n, err := ParseNumber([]byte(s))
+		r.NoError(err)
+		return n
+	}
+
+	r.True(parse("1.5").Equal(parse("1.50")))
+	r.True(parse("1.5").Equal(NewNumber(1, 5)))
+	r.True(parse("0").Equal(parse("-0.0")))
+	r.False(parse("1.05").Equal(parse("1.5")))
+	r.False(parse("-0.5").Equal(parse("0.5")))
+	r.False(NaN.Equal(NaN))
+}
+
+func TestCatalog(t *testing.T) {
+	r := require.New(t)
+
+	n, ok := LookupCommand("three_in_one")
+	r.True(ok)
+	r.Equal(QThreeInOne, n)
+
+	n, ok = LookupCommand("Q100")
+	r.True(ok)
+	r.Equal(QMachineSN, n)
+
+	n, ok = LookupCommand("999")
+	r.True(ok)
+	r.Equal(Int(999), n)
+
+	_, ok = LookupCommand("no_such_command")
+	r.False(ok)
+	_, ok = LookupCommand("-1")
+	r.False(ok)
+
+	name, ok := CommandName(QPowerOnTime)
+	r.True(ok)
+	r.Equal("power_on_time", name)
+	_, ok = CommandName(Int(999))
+	r.False(ok)
+}
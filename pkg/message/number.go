@@ -38,21 +38,34 @@ var (
 	numberFrac   = numberFormat.SubexpIndex("frac")
 )
 
-// A Number represents a fixed-point decimal value.
+// A Number represents a fixed-point decimal value. Numbers are normalized, so
+// that two Numbers with the same decimal value are equal.
 type Number struct {
 	whole, frac int64
-	nan         bool
+	// scale is the number of digits in the fractional part, which may
+	// include leading zeros. Trailing zeros are removed.
+	scale int
+	// neg records the sign of a value between -1 and 0, which cannot be
+	// carried by whole.
+	neg bool
+	nan bool
 }
 
 // NaN is not a [Number].
 var NaN = Number{nan: true}
 
-// NewNumber constructs a number with a whole and fractional part.
+// NewNumber constructs a number with a whole and fractional part. The
+// fractional part cannot represent leading zeros; use [ParseNumber] for
+// values such as 1.05.
 func NewNumber(whole, frac int64) Number {
 	if frac < 0 {
 		panic("frac must be non-negative")
 	}
-	return Number{whole: whole, frac: frac}
+	scale := 0
+	for f := frac; f > 0; f /= 10 {
+		scale++
+	}
+	return Number{whole: whole, frac: frac, scale: scale}.normalize()
 }
 
 // Int returns the integer as a parsed Number.
@@ -65,7 +78,8 @@ func Int64(i int64) Number {
 	return Number{whole: i}
 }
 
-// ParseNumber validates the input is numeric.
+// ParseNumber validates the input is numeric. The digits of the fractional
+// part are retained exactly.
 func ParseNumber(buf []byte) (Number, error) {
 	buf = bytes.TrimSpace(buf)
 
@@ -85,15 +99,34 @@ func ParseNumber(buf []byte) (Number, error) {
 	if err != nil {
 		return NaN, err
 	}
-	var frac int64
-	if len(match[numberFrac]) > 0 {
-		frac, err = strconv.ParseInt(string(match[numberFrac]), 10, 64)
+	ret := Number{whole: whole}
+	if digits := match[numberFrac]; len(digits) > 0 {
+		ret.frac, err = strconv.ParseInt(string(digits), 10, 64)
 		if err != nil {
 			return NaN, err
 		}
+		ret.scale = len(digits)
+		ret.neg = whole == 0 && match[numberWhole][0] == '-'
 	}
+	return ret.normalize(), nil
+}
 
-	return NewNumber(whole, frac), nil
+// Equal returns true if the numbers have exactly the same decimal value. NaN
+// is not equal to any Number.
+func (n Number) Equal(o Number) bool {
+	return !n.nan && !o.nan && n == o
+}
+
+// normalize removes trailing zeros from the fractional part.
+func (n Number) normalize() Number {
+	for n.scale > 0 && n.frac%10 == 0 {
+		n.frac /= 10
+		n.scale--
+	}
+	if n.frac == 0 {
+		n.neg = false
+	}
+	return n
 }
 
 // Float64 returns the Number as a floating-point value.
@@ -101,16 +134,31 @@ func (n Number) Float64() float64 {
 	if n.IsNaN() {
 		return math.NaN()
 	}
-	w := float64(n.whole)
 	if n.frac == 0 {
-		return w
+		return float64(n.whole)
+	}
+	// Parsing the decimal form avoids rounding errors.
+	var buf [48]byte
+	f, _ := strconv.ParseFloat(string(n.appendDecimal(buf[:0])), 64)
+	return f
+}
+
+// appendDecimal appends the decimal form of the number to the buffer.
+func (n Number) appendDecimal(buf []byte) []byte {
+	if n.neg {
+		buf = append(buf, '-')
+	}
+	buf = strconv.AppendInt(buf, n.whole, 10)
+	buf = append(buf, '.')
+	digits := strconv.AppendInt(nil, n.frac, 10)
+	for i := len(digits); i < n.scale; i++ {
+		buf = append(buf, '0')
 	}
-	f := math.Copysign(float64(n.frac), w)
-	d := math.Pow(10, -math.Floor(math.Log10(float64(n.Frac())))-1)
-	return math.FMA(f, d, w)
+	return append(buf, digits...)
 }
 
-// Frac returns the fractional portion of the Number.
+// Frac returns the fractional portion of the Number, without any leading
+// zeros.
 func (n Number) Frac() int64 {
 	return n.frac
 }
@@ -126,10 +174,7 @@ func (n Number) LogValue() slog.Value {
 	if n.frac == 0 {
 		return slog.Int64Value(n.whole)
 	}
-	w := float64(n.whole)
-	f := float64(n.frac)
-	v := math.FMA(f, math.Pow(10, -math.Ceil(math.Log10(f))), w)
-	return slog.Float64Value(v)
+	return slog.Float64Value(n.Float64())
 }
 
 // Whole returns the whole portion of the Number.
@@ -150,7 +195,8 @@ func (n Number) Format(state fmt.State, verb rune) {
 			if prec, ok := state.Precision(); ok && prec == 0 {
 				_, err = fmt.Fprintf(state, "%d", n.whole)
 			} else {
-				_, err = fmt.Fprintf(state, "%d.%d", n.whole, n.frac)
+				var buf [48]byte
+				_, err = state.Write(n.appendDecimal(buf[:0]))
 			}
 		default:
 			panic("unsupported verb")